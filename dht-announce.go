@@ -0,0 +1,210 @@
+package dht
+
+import "time"
+
+// An infohash for which this node announces itself as a peer. Announcements
+// are repeated periodically so that they do not expire from other nodes.
+type originatedInfoHash struct {
+	port int // Announce port, or ImpliedPort.
+
+	// When the infohash is next to be announced.
+	nextAnnounce time.Time
+
+	// Set while a lookup is in progress which is to be followed by an
+	// announcement.
+	announcing bool
+
+	// When the most recent announcement concluded, and its outcome.
+	lastAnnounced           time.Time
+	numQueried, numAccepted int
+
+	// How long to wait before retrying if the current announcement is accepted
+	// by no node. Zero after an announcement has been accepted.
+	retryDelay time.Duration
+}
+
+// Delay before retrying an announcement which no node accepted, such as one
+// made before the routing table has filled. The delay doubles with each
+// further failure, up to the reannounce period.
+const reannounceRetryMin = 5 * time.Second
+
+// An announcement of this node as a peer for a locally originated infohash,
+// for which responses are awaited.
+type announce struct {
+	numQueried  int
+	numAccepted int
+
+	// Number of announce_peer queries for which no response has been received.
+	numPending int
+}
+
+// l: Announcing. {{{1
+
+// Set whether an infohash is one we announce for, and on which port. An
+// infohash newly announced for is announced immediately, as is one whose retry
+// after an announcement accepted by no node has come due.
+func (dht *DHT) lSetLocallyOriginated(infoHash InfoHash, announce bool, port int) {
+	if !announce {
+		delete(dht.locallyOriginated, infoHash)
+		return
+	}
+
+	o, ok := dht.locallyOriginated[infoHash]
+	if ok {
+		o.port = port
+		if o.retryDelay != 0 && !o.announcing && !dht.cfg.Clock.Now().Before(o.nextAnnounce) {
+			dht.lReannounce(infoHash, o)
+		}
+		return
+	}
+
+	o = &originatedInfoHash{port: port}
+	dht.locallyOriginated[infoHash] = o
+	dht.lReannounce(infoHash, o)
+}
+
+// Start a lookup for an infohash to be followed by an announcement, and
+// schedule the next one.
+func (dht *DHT) lReannounce(infoHash InfoHash, o *originatedInfoHash) {
+	o.announcing = true
+	o.nextAnnounce = dht.cfg.Clock.Now().Add(jitter(dht.cfg.ReannouncePeriod))
+
+	closest := dht.neighbourhood.routingTable.LookupFiltered(infoHash, dht.lRecontactFilterPredicate)
+	dht.lStartLookup("get_peers", infoHash, closest)
+}
+
+// Announce any infohashes which are due to be announced again. Called
+// periodically.
+func (dht *DHT) lReannounceDue() {
+	now := dht.cfg.Clock.Now()
+	for infoHash, o := range dht.locallyOriginated {
+		if !now.Before(o.nextAnnounce) {
+			dht.lReannounce(infoHash, o)
+		}
+	}
+}
+
+// Called when a get_peers lookup has converged. GetPeers callers are told that
+// no more peers are forthcoming. If an announcement of the infohash is due,
+// announce to the closest nodes which issued us tokens.
+func (dht *DHT) lPeersLookupFinished(l *lookup) {
+	dht.lEndPeerSubscriptions(l.target)
+
+	o, ok := dht.locallyOriginated[l.target]
+	if !ok || !o.announcing {
+		return
+	}
+
+	o.announcing = false
+	dht.lAnnounce(l.target, o.port, l.responders())
+}
+
+// Send announce_peer queries for an infohash to the chosen responders. Any
+// announcement still awaiting responses is superseded, and responses to its
+// queries are disregarded.
+func (dht *DHT) lAnnounce(infoHash InfoHash, port int, responders []tokenResponder) {
+	chosen := dht.lStorageNodes(responders)
+	a := &announce{
+		numQueried: len(chosen),
+		numPending: len(chosen),
+	}
+	dht.announces[infoHash] = a
+
+	for _, r := range chosen {
+		dht.lTxAnnouncePeer(r.n, a, infoHash, r.token, port)
+	}
+
+	if a.numPending == 0 {
+		dht.lConcludeAnnounce(infoHash, a)
+	}
+}
+
+// Called from RX when a node accepts an announcement.
+func (dht *DHT) lAnnounceAccepted(infoHash InfoHash, a *announce) {
+	if dht.announces[infoHash] != a {
+		// Superseded.
+		return
+	}
+
+	a.numAccepted++
+	a.numPending--
+	if a.numPending <= 0 {
+		dht.lConcludeAnnounce(infoHash, a)
+	}
+}
+
+// Called when an announce_peer query has failed.
+func (dht *DHT) lAnnounceFailed(infoHash InfoHash, a *announce) {
+	if dht.announces[infoHash] != a {
+		// Superseded.
+		return
+	}
+
+	a.numPending--
+	if a.numPending <= 0 {
+		dht.lConcludeAnnounce(infoHash, a)
+	}
+}
+
+// Report the outcome of an announcement once every node has responded or
+// failed to.
+func (dht *DHT) lConcludeAnnounce(infoHash InfoHash, a *announce) {
+	delete(dht.announces, infoHash)
+
+	if o, ok := dht.locallyOriginated[infoHash]; ok {
+		o.lastAnnounced = dht.cfg.Clock.Now()
+		o.numQueried = a.numQueried
+		o.numAccepted = a.numAccepted
+		dht.lScheduleRetry(o)
+	}
+
+	res := AnnounceResult{
+		InfoHash:    infoHash,
+		NumQueried:  a.numQueried,
+		NumAccepted: a.numAccepted,
+	}
+	log.Debugf("cl(%v) announce finished %+v", dht.cfg.NodeID.ShortString(), res)
+
+	select {
+	case dht.announceChan <- res:
+	default:
+		// The client is not keeping up.
+	}
+}
+
+// Bring the next announcement forward if the one just concluded was accepted
+// by no node.
+func (dht *DHT) lScheduleRetry(o *originatedInfoHash) {
+	if o.numAccepted > 0 {
+		o.retryDelay = 0
+		return
+	}
+
+	if o.retryDelay == 0 {
+		o.retryDelay = reannounceRetryMin
+	} else {
+		o.retryDelay *= 2
+	}
+	if o.retryDelay > dht.cfg.ReannouncePeriod {
+		o.retryDelay = dht.cfg.ReannouncePeriod
+	}
+
+	o.nextAnnounce = dht.cfg.Clock.Now().Add(jitter(o.retryDelay))
+}
+
+func (dht *DHT) lListAnnounces() []AnnounceInfo {
+	var info []AnnounceInfo
+
+	for infoHash, o := range dht.locallyOriginated {
+		info = append(info, AnnounceInfo{
+			InfoHash:      infoHash,
+			Port:          o.port,
+			LastAnnounced: o.lastAnnounced,
+			NumQueried:    o.numQueried,
+			NumAccepted:   o.numAccepted,
+			NextAnnounce:  o.nextAnnounce,
+		})
+	}
+
+	return info
+}
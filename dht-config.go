@@ -27,6 +27,33 @@ type Config struct {
 	// How often to rotate announce_peer tokens. Default: 10 minutes.
 	TokenRotatePeriod time.Duration `usage:"How often to rotate announce_peer tokens"`
 
+	// How often to put data stored by this node again so that it does not
+	// expire. Default: 1 hour.
+	RepublishPeriod time.Duration `usage:"How often to republish data put by this node"`
+
+	// How often to announce infohashes for which this node is a peer again, so
+	// that the announcements do not expire. Each interval is randomly adjusted
+	// by up to a tenth either way. Default: 15 minutes.
+	ReannouncePeriod time.Duration `usage:"How often to announce infohashes again"`
+
+	// How long data put by other nodes are stored for unless put again.
+	// Default: 2 hours.
+	DatumLifetime time.Duration `usage:"How long to store data put by other nodes"`
+
+	// How long to wait for a response to a query before deeming it to have
+	// failed. Nodes whose RTT is known are waited for only as long as their
+	// retransmission timeouts allow, up to this limit. Default: 5 seconds.
+	QueryTimeout time.Duration `usage:"How long to wait for a response to a query"`
+
+	// Maximum number of times to retransmit an unanswered query within
+	// QueryTimeout. The retransmission timeout is based on the node's RTT and
+	// doubles with each retransmission. If negative, queries are never
+	// retransmitted. Default: 2.
+	MaxRetransmits int `usage:"Maximum number of times to retransmit an unanswered query"`
+
+	// Number of queries kept in flight by each iterative lookup. Default: 3.
+	LookupConcurrency int `usage:"Number of queries in flight per lookup"`
+
 	// ...
 	SearchRetryPeriod time.Duration `usage:"Search retry period"`
 
@@ -40,12 +67,41 @@ type Config struct {
 	// The maximum number of peers to track for each infohash. Default: 256.
 	MaxInfoHashPeers int `usage:"Maximum number of values to store for a given infohash"`
 
+	// The maximum total size in bytes of data put by other nodes to store.
+	// Default: 4 MiB.
+	MaxDatumStorage int `usage:"Maximum total size of data to store for other nodes"`
+
+	// The maximum number of data to store on behalf of a single IP address.
+	// Default: 64.
+	MaxDatumsPerIP int `usage:"Maximum number of data to store for a single IP"`
+
+	// The maximum number of data to store on behalf of a single /24 (IPv4) or
+	// /64 (IPv6) subnet. Default: 256.
+	MaxDatumsPerSubnet int `usage:"Maximum number of data to store for a single subnet"`
+
 	// The maximum number of pending queries before a node is considered unreachable.
 	MaxPendingQueries int `usage:"Maximum number of pending queries before a node is considered unreachable"`
 
 	// Node ID. A random Node ID is generated if this is left blank.
 	NodeID NodeID `usage:"Node ID"`
 
+	// How the BEP 42 node ID restrictions are applied to other nodes.
+	// Default: NodeIDPolicyIgnore.
+	NodeIDPolicy NodeIDPolicy
+
+	// The structure used to track nodes for routing.
+	// Default: RoutingTableTrie.
+	RoutingTable RoutingTableKind
+
+	// Maximum number of peer results queued for a client which is not keeping
+	// up, on PeersChan and on each channel returned by GetPeers.
+	// Default: 256.
+	PeerQueueLen int `usage:"Maximum number of peer results queued for the client"`
+
+	// Which peer results are discarded when a queue is full.
+	// Default: OverflowDropOldest.
+	PeerQueueOverflow OverflowPolicy
+
 	// If not set, request peers only of the address family (IPv4 or IPv6) used to make
 	// requests. If set, request peers of all supported address families (IPv4, IPv6).
 	AnyPeerAF bool `usage:"Return peers of all address families"`
@@ -78,6 +134,34 @@ func (cfg *Config) setDefaults() {
 		cfg.TokenRotatePeriod = 5 * time.Minute
 	}
 
+	if cfg.RepublishPeriod == 0 {
+		cfg.RepublishPeriod = 1 * time.Hour
+	}
+
+	if cfg.ReannouncePeriod == 0 {
+		cfg.ReannouncePeriod = 15 * time.Minute
+	}
+
+	if cfg.PeerQueueLen == 0 {
+		cfg.PeerQueueLen = 256
+	}
+
+	if cfg.DatumLifetime == 0 {
+		cfg.DatumLifetime = 2 * time.Hour
+	}
+
+	if cfg.QueryTimeout == 0 {
+		cfg.QueryTimeout = 5 * time.Second
+	}
+
+	if cfg.MaxRetransmits == 0 {
+		cfg.MaxRetransmits = 2
+	}
+
+	if cfg.LookupConcurrency == 0 {
+		cfg.LookupConcurrency = 3
+	}
+
 	if cfg.SearchRetryPeriod == 0 {
 		cfg.SearchRetryPeriod = 15 * time.Second
 	}
@@ -94,6 +178,18 @@ func (cfg *Config) setDefaults() {
 		cfg.MaxInfoHashPeers = 256
 	}
 
+	if cfg.MaxDatumStorage == 0 {
+		cfg.MaxDatumStorage = 4 * 1024 * 1024
+	}
+
+	if cfg.MaxDatumsPerIP == 0 {
+		cfg.MaxDatumsPerIP = 64
+	}
+
+	if cfg.MaxDatumsPerSubnet == 0 {
+		cfg.MaxDatumsPerSubnet = 256
+	}
+
 	if cfg.MaxPendingQueries == 0 {
 		cfg.MaxPendingQueries = 5
 	}
@@ -101,4 +197,8 @@ func (cfg *Config) setDefaults() {
 	if !cfg.NodeID.Valid() {
 		cfg.NodeID = GenerateNodeID()
 	}
+
+	if cfg.Clock == nil {
+		cfg.Clock = clock.Real
+	}
 }
@@ -0,0 +1,234 @@
+package dht
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// How long a datum search may run before it is concluded with whatever
+// responses have been received.
+const datumSearchDuration = 10 * time.Second
+
+// Represents an in-progress BEP 44 get operation, optionally followed by a
+// put operation.
+type datumSearch struct {
+	target    InfoHash
+	salt      []byte  // Salt for mutable data, needed to verify values.
+	seq       *uint64 // If set, only values newer than this are requested.
+	deadline  time.Time
+	wantValue bool   // Deliver the retrieved value on DatumChan?
+	put       *Datum // If set, put this datum once the search concludes.
+
+	// Channels to deliver the result on, for internally generated requests.
+	resultChans []chan<- DatumResult
+
+	// Nodes which have responded, sorted by distance to the target.
+	responders []tokenResponder
+
+	// Values served by responding nodes.
+	values []DatumValue
+
+	// The best verified value retrieved, if any. For mutable data, this is the
+	// value with the highest sequence number.
+	value *Datum
+}
+
+// A node which has responded to a get or get_peers query, along with the write
+// token it issued.
+type tokenResponder struct {
+	n     *node
+	token []byte
+}
+
+// Record a responding node, keeping the responder list ordered by distance to
+// the target.
+func (ds *datumSearch) addResponder(n *node, token []byte) {
+	for _, r := range ds.responders {
+		if r.n == n {
+			return
+		}
+	}
+
+	ds.responders = append(ds.responders, tokenResponder{n: n, token: token})
+	sort.Slice(ds.responders, func(i, j int) bool {
+		return hashDistance(ds.target, InfoHash(ds.responders[i].n.NodeID)) < hashDistance(ds.target, InfoHash(ds.responders[j].n.NodeID))
+	})
+}
+
+// Record a value served by a node. The value is verified against the target
+// and, if valid and newer than any value seen so far, becomes the search
+// result. Forged and stale values are recorded but otherwise ignored.
+func (ds *datumSearch) addValue(n *node, v *krGetRes) {
+	d := &Datum{
+		Value:     v.Value,
+		Key:       v.Key,
+		Salt:      ds.salt,
+		Signature: v.Signature,
+	}
+	if v.SequenceNo != nil {
+		d.SequenceNo = *v.SequenceNo
+	}
+
+	// Mutable values must come with a sequence number.
+	verified := d.verify(ds.target) && (!d.IsMutable() || v.SequenceNo != nil)
+
+	ds.values = append(ds.values, DatumValue{
+		Node: NodeLocator{
+			NodeID: n.NodeID,
+			Addr:   n.Addr,
+		},
+		Datum:    d,
+		Verified: verified,
+	})
+
+	if verified && (ds.value == nil || (d.IsMutable() && d.SequenceNo > ds.value.SequenceNo)) {
+		ds.value = d
+	}
+}
+
+// l: Datum searching. {{{1
+
+// Called via channel from client. Starts a search for the target, or joins an
+// existing one. The salt is needed to verify salted mutable data and may be
+// nil otherwise.
+func (dht *DHT) lRequestDatum(rdi requestDatumInfo) {
+	target := rdi.Target
+
+	ds, ok := dht.datumSearches[target]
+	if !ok {
+		ds = &datumSearch{
+			target:   target,
+			seq:      rdi.Seq,
+			deadline: dht.cfg.Clock.Now().Add(datumSearchDuration),
+		}
+		dht.datumSearches[target] = ds
+	} else if ds.seq != nil && (rdi.Seq == nil || *rdi.Seq < *ds.seq) {
+		// Queries yet to be sent should not exclude values this request wants.
+		ds.seq = rdi.Seq
+	}
+
+	if rdi.Salt != nil {
+		ds.salt = rdi.Salt
+	}
+
+	switch {
+	case rdi.Datum != nil:
+		ds.put = rdi.Datum
+		ds.salt = rdi.Datum.Salt
+	case rdi.ResultChan != nil:
+		ds.resultChans = append(ds.resultChans, rdi.ResultChan)
+	default:
+		ds.wantValue = true
+	}
+
+	if ok {
+		return
+	}
+
+	// We may be one of the nodes storing the datum ourselves.
+	ds.value = dht.datumStore.Get(target, dht.cfg.Clock.Now())
+
+	// The search concludes when the lookup does.
+	closest := dht.neighbourhood.routingTable.LookupFiltered(target, dht.lDatumFilterPredicate)
+	dht.lStartLookup("get", target, closest)
+}
+
+func (dht *DHT) lDatumFilterPredicate(infoHash InfoHash, n *node) bool {
+	return n.NodeID.Valid() && n.NumPendingQueries() < dht.cfg.MaxPendingQueries
+}
+
+// Called from RX when a get response is received for a target. The lookup
+// takes care of querying any closer nodes.
+func (dht *DHT) lDatumResponse(target InfoHash, n *node, v *krGetRes) {
+	ds, ok := dht.datumSearches[target]
+	if !ok {
+		// The search has already concluded.
+		return
+	}
+
+	if len(v.Token) > 0 {
+		ds.addResponder(n, v.Token)
+	}
+
+	if len(v.Value) > 0 {
+		ds.addValue(n, v)
+	}
+}
+
+// Choose up to kNodes of the given responders, which must be sorted by
+// distance, to store a datum or announcement. Unless BEP 42 node IDs are
+// ignored, responders with secure IDs are preferred over closer ones without.
+func (dht *DHT) lStorageNodes(responders []tokenResponder) []tokenResponder {
+	var chosen, insecure []tokenResponder
+	for _, r := range responders {
+		if dht.cfg.NodeIDPolicy == NodeIDPolicyIgnore || r.n.HasSecureID() {
+			chosen = append(chosen, r)
+		} else {
+			insecure = append(insecure, r)
+		}
+	}
+
+	chosen = append(chosen, insecure...)
+	if len(chosen) > kNodes {
+		chosen = chosen[:kNodes]
+	}
+
+	return chosen
+}
+
+// Called when the get lookup for a target has converged.
+func (dht *DHT) lDatumLookupFinished(target InfoHash) {
+	ds, ok := dht.datumSearches[target]
+	if ok {
+		dht.lConcludeDatumSearch(ds)
+	}
+}
+
+// Conclude any datum searches which have run for too long. Called
+// periodically.
+func (dht *DHT) lExpireDatumSearches() {
+	now := dht.cfg.Clock.Now()
+	for _, ds := range dht.datumSearches {
+		if now.After(ds.deadline) {
+			dht.lConcludeDatumSearch(ds)
+		}
+	}
+}
+
+// Conclude a datum search, returning the value to the client if one was
+// requested and storing the datum to the closest responding nodes if a put was
+// requested.
+func (dht *DHT) lConcludeDatumSearch(ds *datumSearch) {
+	delete(dht.datumSearches, ds.target)
+	if l, ok := dht.lookups[lookupKey{"get", ds.target}]; ok {
+		dht.lFinishLookup(l)
+	}
+
+	if ds.put != nil {
+		dht.lDatumPutStarted(ds.target, ds.put)
+
+		for _, r := range dht.lStorageNodes(ds.responders) {
+			dht.lTxPut(r.n, ds.target, r.token, ds.put)
+		}
+	}
+
+	result := DatumResult{
+		Target: ds.target,
+		Datum:  ds.value,
+		Values: ds.values,
+	}
+
+	for _, ch := range ds.resultChans {
+		ch <- result
+	}
+
+	if ds.wantValue {
+		select {
+		case dht.datumChan <- result:
+		default:
+			// The client is not keeping up.
+			atomic.AddUint64(&dht.numDroppedData, 1)
+		}
+	}
+}
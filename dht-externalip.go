@@ -0,0 +1,59 @@
+package dht
+
+import "net"
+
+const (
+	// Maximum number of nodes whose reports of our external IP are remembered.
+	externalIPMaxReporters = 64
+
+	// Minimum number of nodes which must agree on our external IP.
+	externalIPMinVotes = 3
+)
+
+// l: External IP. {{{1
+
+// Called from RX when a node reports our external address in a response.
+func (dht *DHT) lExternalAddrReported(reporter net.UDPAddr, addr net.UDPAddr) {
+	dht.ipVote.Add(reporter.IP, addr.IP)
+
+	ip := dht.ipVote.Result()
+	if ip == nil || ip.Equal(dht.externalIP) {
+		return
+	}
+
+	log.Noticef("external IP is %v", ip)
+	dht.stateMutex.Lock()
+	dht.externalIP = ip
+	dht.stateMutex.Unlock()
+
+	if dht.nodeIDGenerated && !nodeIDIsSecure(ip, dht.cfg.NodeID) {
+		dht.lChangeNodeID(conformNodeID(ip, GenerateNodeID()))
+	}
+}
+
+// Change our node ID. Nodes close to the new ID are sought and locally
+// originated infohashes are announced again under it.
+func (dht *DHT) lChangeNodeID(nodeID NodeID) {
+	log.Noticef("changing node ID from %v to %v", dht.cfg.NodeID, nodeID)
+	dht.stateMutex.Lock()
+	dht.cfg.NodeID = nodeID
+	dht.stateMutex.Unlock()
+
+	dht.neighbourhood.SetNodeID(nodeID)
+	dht.lProcRecurseNode(nodeID)
+
+	for infoHash, o := range dht.locallyOriginated {
+		dht.lReannounce(infoHash, o)
+	}
+}
+
+// Returns true iff the address is known to be our own. Other nodes may still
+// refer to us under a node ID we have since abandoned.
+func (dht *DHT) lIsOwnAddr(addr net.UDPAddr) bool {
+	local, ok := dht.conn.LocalAddr().(*net.UDPAddr)
+	if !ok || addr.Port != local.Port {
+		return false
+	}
+
+	return addr.IP.Equal(local.IP) || addr.IP.Equal(dht.externalIP)
+}
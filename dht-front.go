@@ -4,13 +4,24 @@ package dht
 // goroutine.
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/hlandau/dht/krpc"
 	"net"
 	"sync/atomic"
+	"time"
 )
 
+// Returned by methods called after the DHT has been stopped.
+var ErrStopped = errors.New("DHT stopped")
+
 // Information about a given node.
 type NodeInfo struct {
 	NodeLocator
+
+	// Smoothed round-trip time to the node. Zero if not yet known.
+	RTT time.Duration
 }
 
 // Represents a peer address identified for a given infohash.
@@ -23,6 +34,119 @@ type PeerResult struct {
 	Addr net.UDPAddr
 }
 
+// Represents the outcome of a datum request.
+type DatumResult struct {
+	// The target to which the result pertains.
+	Target InfoHash
+
+	// The datum retrieved, or nil if no responding node had a valid value for
+	// the target. For mutable data, this is the valid value with the highest
+	// sequence number.
+	Datum *Datum
+
+	// The values served by each responding node, including those which failed
+	// verification.
+	Values []DatumValue
+}
+
+// A value served by a node in response to a get query.
+type DatumValue struct {
+	// The node which served the value.
+	Node NodeLocator
+
+	// The value served.
+	Datum *Datum
+
+	// True iff the value matches the target and, for mutable data, is validly
+	// signed.
+	Verified bool
+}
+
+// Information about a datum which this node keeps alive in the DHT.
+type PublishedDatumInfo struct {
+	// The target under which the datum is stored.
+	Target InfoHash
+
+	// The datum being published.
+	Datum *Datum
+
+	// When a node last accepted the datum. Zero if no node has yet done so.
+	LastStored time.Time
+
+	// The number of nodes which accepted the datum in the most recent put
+	// cycle.
+	NumStored int
+
+	// The most recent error with which a node rejected the datum, if any.
+	LastError error
+}
+
+// Information about an infohash for which this node announces itself as a
+// peer.
+type AnnounceInfo struct {
+	// The infohash announced.
+	InfoHash InfoHash
+
+	// The announce port, or ImpliedPort.
+	Port int
+
+	// When the most recent announcement concluded. Zero if none has yet.
+	LastAnnounced time.Time
+
+	// The outcome of the most recent announcement.
+	NumQueried, NumAccepted int
+
+	// When the infohash is next due to be announced.
+	NextAnnounce time.Time
+}
+
+// Represents the outcome of announcing this node as a peer for an infohash.
+type AnnounceResult struct {
+	// The infohash announced.
+	InfoHash InfoHash
+
+	// The number of nodes to which the announcement was sent. These are the
+	// nodes closest to the infohash which issued us write tokens.
+	NumQueried int
+
+	// The number of nodes which accepted the announcement.
+	NumAccepted int
+}
+
+// Statistics for a completed iterative lookup.
+type LookupResult struct {
+	// The query method used, which is "find_node", "get_peers" or "get".
+	Method string
+
+	// The infohash or target looked up.
+	Target InfoHash
+
+	// The greatest number of hops from our routing table to a node which
+	// responded.
+	Hops int
+
+	// The number of nodes queried and the number which responded.
+	NumQueried, NumResponded int
+
+	// How long the lookup took to converge.
+	Duration time.Duration
+}
+
+// Represents an error response to a query sent by this node.
+type QueryError struct {
+	// The query method, such as "announce_peer" or "put".
+	Method string
+
+	// The node which responded with the error.
+	Node NodeLocator
+
+	// The infohash or target the query pertained to, if any.
+	Target InfoHash
+
+	// The error received.
+	Err *krpc.Error
+}
+
 type addNodeInfo struct {
 	NodeLocator
 	ForceAdd bool
@@ -31,20 +155,116 @@ type addNodeInfo struct {
 type requestPeersInfo struct {
 	InfoHash InfoHash
 	Announce bool
+	Port     int
+
+	// If set, the request is ignored if this has been closed by the time it is
+	// processed.
+	Cancel <-chan struct{}
+
+	// The standing search making the request, or nil for the client.
+	Search *search
+}
+
+type forgetInfo struct {
+	InfoHash InfoHash
+	Interest bool    // Also lose interest, rather than only stop announcing.
+	Search   *search // As for requestPeersInfo.
+}
+
+type requestDatumInfo struct {
+	Target InfoHash
+	Salt   []byte
+	Seq    *uint64
+	Datum  *Datum // Set for puts.
+
+	// If set, the result is delivered here instead of on DatumChan.
+	ResultChan chan<- DatumResult
 }
 
 // Peer search results will be returned on this channel. It is closed when the
-// node is stopped.
+// node is stopped. Up to Config.PeerQueueLen results are queued if the channel
+// is not read from promptly; beyond that, results are discarded according to
+// Config.PeerQueueOverflow.
 func (dht *DHT) PeersChan() <-chan PeerResult {
-	return dht.peersChan
+	return dht.peersQueue.Chan()
+}
+
+// Returns the number of peer results discarded so far, on PeersChan or any
+// channel returned by GetPeers, because they were not read promptly.
+func (dht *DHT) DroppedPeers() uint64 {
+	return atomic.LoadUint64(&dht.numDroppedPeers)
+}
+
+// Datum request results will be returned on this channel. It is closed when
+// the node is stopped. Up to 10 results are queued if the channel is not read
+// from promptly; beyond that, results are discarded and counted by
+// DroppedData.
+func (dht *DHT) DatumChan() <-chan DatumResult {
+	return dht.datumChan
 }
 
-// Stop the DHT instance. Do not call any other method after calling this.
+// Returns the number of datum results discarded so far because DatumChan was
+// not read promptly.
+func (dht *DHT) DroppedData() uint64 {
+	return atomic.LoadUint64(&dht.numDroppedData)
+}
+
+// Error responses to queries sent by this node will be returned on this
+// channel. Errors are discarded if the channel is not read from promptly. It
+// is closed when the DHT is stopped.
+func (dht *DHT) QueryErrorChan() <-chan QueryError {
+	return dht.queryErrorChan
+}
+
+// The outcome of each announcement will be returned on this channel. Results
+// are discarded if the channel is not read from promptly. It is closed when the
+// DHT is stopped.
+func (dht *DHT) AnnounceChan() <-chan AnnounceResult {
+	return dht.announceChan
+}
+
+// Statistics for each completed lookup will be returned on this channel.
+// Results are discarded if the channel is not read from promptly. It is closed
+// when the DHT is stopped.
+func (dht *DHT) LookupChan() <-chan LookupResult {
+	return dht.lookupChan
+}
+
+// Stop the DHT instance. Returns once its goroutines, including those serving
+// searches, watches and GetPeers calls, have exited and its socket has been
+// closed. Methods called afterwards return ErrStopped or a zero result. May be
+// called multiple times without consequence.
 func (dht *DHT) Stop() error {
 	dht.stopOnce.Do(func() {
+		dht.loopsMutex.Lock()
 		atomic.StoreUint32(&dht.stopping, 1)
+		dht.loopsMutex.Unlock()
+
 		close(dht.stopChan)
 	})
+
+	dht.loops.Wait()
+	<-dht.peersQueue.Done()
+	return nil
+}
+
+// Returns true once Stop has been called.
+func (dht *DHT) isStopped() bool {
+	return atomic.LoadUint32(&dht.stopping) != 0
+}
+
+// Registers a goroutine started on behalf of the client, which Stop is to
+// wait for. It must call dht.loops.Done when it exits. Returns ErrStopped,
+// registering nothing, if Stop has been called.
+func (dht *DHT) addLoop() error {
+	dht.loopsMutex.Lock()
+	defer dht.loopsMutex.Unlock()
+
+	if dht.isStopped() {
+		return ErrStopped
+	}
+
+	dht.loops.Add(1)
 	return nil
 }
 
@@ -55,59 +275,328 @@ func AddHost(dht *DHT, hostname string, nodeID NodeID) error {
 		return err
 	}
 
-	dht.AddNode(NodeLocator{
+	return dht.addNode(NodeLocator{
 		Addr:   *addr,
 		NodeID: nodeID,
-	})
-	return nil
+	}, false)
 }
 
 // Soft-adds a node to the DHT. You must call this with at least one node to
 // bootstrap the DHT. Address is in format "IP:port". The node ID is optional.
+// Does nothing once the DHT has been stopped.
 func (dht *DHT) AddNode(nodeLocator NodeLocator) {
 	dht.addNode(nodeLocator, false)
 }
 
 // Hard-adds a node to the DHT. Adds the node even if there are already enough
-// nodes added.
+// nodes added. Does nothing once the DHT has been stopped.
 func (dht *DHT) ForceAddNode(nodeLocator NodeLocator) {
 	dht.addNode(nodeLocator, true)
 }
 
 // Get the l-goroutine to handle the node addition.
-func (dht *DHT) addNode(nodeLocator NodeLocator, forceAdd bool) {
-	dht.addNodeChan <- addNodeInfo{nodeLocator, forceAdd}
+func (dht *DHT) addNode(nodeLocator NodeLocator, forceAdd bool) error {
+	if dht.isStopped() {
+		return ErrStopped
+	}
+
+	select {
+	case dht.addNodeChan <- addNodeInfo{nodeLocator, forceAdd}:
+		return nil
+	case <-dht.stopChan:
+		return ErrStopped
+	}
 }
 
+// Pass as the announce port to have other nodes record the source port of
+// our DHT packets as our peer port (BEP 5 implied_port), rather than a port
+// given explicitly.
+const ImpliedPort = 0
+
 // Request peers for an infohash. If announce is set to true, this node will be
-// signed up as a peer.
-func (dht *DHT) RequestPeers(infoHash InfoHash, announce bool) error {
-	dht.requestPeersChan <- requestPeersInfo{
+// signed up as a peer on the given port, which may be ImpliedPort. The port is
+// ignored if announce is false.
+func (dht *DHT) RequestPeers(infoHash InfoHash, announce bool, port int) error {
+	if announce && (port < 0 || port > 65535) {
+		return fmt.Errorf("invalid announce port: %d", port)
+	}
+
+	return dht.requestPeers(requestPeersInfo{
 		InfoHash: infoHash,
 		Announce: announce,
+		Port:     port,
+	})
+}
+
+func (dht *DHT) requestPeers(rpi requestPeersInfo) error {
+	if dht.isStopped() {
+		return ErrStopped
+	}
+
+	select {
+	case dht.requestPeersChan <- rpi:
+		return nil
+	case <-dht.stopChan:
+		return ErrStopped
 	}
-	return nil
 }
 
-// TODO
-func (dht *DHT) RequestDatum(infoHash InfoHash) error {
-	return nil
+// Options for GetPeers.
+type GetPeersOptions struct {
+	// If set, this node is also signed up as a peer for the infohash on Port,
+	// which may be ImpliedPort, as for RequestPeers. The announcement continues
+	// until StopAnnouncing or Forget is called.
+	Announce bool
+	Port     int
+}
+
+// Look up peers for an infohash. Peers already known are returned first,
+// followed by those found by a lookup. Each peer is returned once. The
+// returned channel is closed once the peers found have been read after the
+// lookup finishes, or as soon as ctx is cancelled or the DHT is stopped. Up to
+// Config.PeerQueueLen peers are queued for the caller; beyond that, peers are
+// discarded according to Config.PeerQueueOverflow. Results are not returned on
+// PeersChan unless peers have also been requested with RequestPeers. opts may
+// be nil.
+func (dht *DHT) GetPeers(ctx context.Context, infoHash InfoHash, opts *GetPeersOptions) (<-chan PeerResult, error) {
+	if opts == nil {
+		opts = &GetPeersOptions{}
+	}
+
+	if opts.Announce && (opts.Port < 0 || opts.Port > 65535) {
+		return nil, fmt.Errorf("invalid announce port: %d", opts.Port)
+	}
+
+	// The subscription's queue and the goroutine watching the context are
+	// waited for by Stop.
+	err := dht.addLoop()
+	if err != nil {
+		return nil, err
+	}
+
+	sub := &peerSubscription{
+		infoHash: infoHash,
+		queue:    newPeerQueue(dht.cfg.PeerQueueLen, dht.cfg.PeerQueueOverflow, &dht.numDroppedPeers),
+		sent:     map[string]struct{}{},
+	}
+
+	select {
+	case dht.getPeersChan <- getPeersInfo{Sub: sub, Announce: opts.Announce, Port: opts.Port}:
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-dht.stopChan:
+		err = ErrStopped
+	}
+	if err != nil {
+		sub.queue.Abort()
+		<-sub.queue.Done()
+		dht.loops.Done()
+		return nil, err
+	}
+
+	go func() {
+		defer dht.loops.Done()
+
+		select {
+		case <-ctx.Done():
+			sub.queue.Abort()
+			select {
+			case dht.cancelGetPeersChan <- sub:
+			case <-dht.stopChan:
+			}
+		case <-dht.stopChan:
+			// In case the subscription was never registered.
+			sub.queue.Abort()
+		case <-sub.queue.Done():
+		}
+
+		<-sub.queue.Done()
+	}()
+
+	return sub.queue.Chan(), nil
+}
+
+// Stop announcing this node as a peer for an infohash. Peers are still
+// searched for if requested. Existing announcements will expire from other
+// nodes in due course. Announcements made for searches created with NewSearch
+// continue until they are stopped.
+func (dht *DHT) StopAnnouncing(infoHash InfoHash) {
+	dht.forget(forgetInfo{InfoHash: infoHash})
+}
+
+// Stop announcing for an infohash and lose interest in it, so that no further
+// peers are searched for or returned on PeersChan until RequestPeers is called
+// again. Searches created with NewSearch keep their interest until they are
+// stopped, and GetPeers callers still receive the peers found by the lookup
+// they await.
+func (dht *DHT) Forget(infoHash InfoHash) {
+	dht.forget(forgetInfo{InfoHash: infoHash, Interest: true})
+}
+
+func (dht *DHT) forget(fi forgetInfo) {
+	if dht.isStopped() {
+		return
+	}
+
+	select {
+	case dht.forgetChan <- fi:
+	case <-dht.stopChan:
+	}
+}
+
+// Request the datum stored under the given target. The result will be
+// returned on DatumChan once the search concludes. Salted mutable data cannot
+// be verified without the salt; use RequestMutableDatum to retrieve it.
+func (dht *DHT) RequestDatum(target InfoHash) error {
+	return dht.requestDatum(requestDatumInfo{
+		Target: target,
+	})
+}
+
+// Request the mutable datum stored under the given Ed25519 public key and
+// salt. The salt may be nil. The result will be returned on DatumChan once the
+// search concludes.
+func (dht *DHT) RequestMutableDatum(key, salt []byte) error {
+	if !krPublicKey(key).IsWellFormed() {
+		return fmt.Errorf("malformed public key")
+	}
+
+	return dht.requestDatum(requestDatumInfo{
+		Target: MutableTarget(key, salt),
+		Salt:   salt,
+	})
 }
 
-// TODO
+// Store a datum in the DHT. The nodes closest to the datum's target are located
+// and the datum is put to them. Mutable data must already be signed; see
+// NewMutableDatum.
+//
+// The datum is republished periodically so that it does not expire, until
+// UnpublishDatum is called. Putting a datum with the same target as one already
+// published (e.g. a mutable datum with a new sequence number) replaces it.
 func (dht *DHT) PutDatum(datum *Datum) error {
-	return nil
+	err := checkDatumValue(datum.Value)
+	if err != nil {
+		return err
+	}
+
+	if datum.IsMutable() && !datum.Signature.IsWellFormed() {
+		return fmt.Errorf("mutable datum is not signed")
+	}
+
+	return dht.requestDatum(requestDatumInfo{
+		Target: datum.target(),
+		Datum:  datum,
+	})
+}
+
+// Get the l-goroutine to handle a datum get or put.
+func (dht *DHT) requestDatum(rdi requestDatumInfo) error {
+	if dht.isStopped() {
+		return ErrStopped
+	}
+
+	select {
+	case dht.requestDatumChan <- rdi:
+		return nil
+	case <-dht.stopChan:
+		return ErrStopped
+	}
+}
+
+// Stop republishing the datum with the given target. The datum will expire
+// from the DHT in due course.
+func (dht *DHT) UnpublishDatum(target InfoHash) {
+	if dht.isStopped() {
+		return
+	}
+
+	select {
+	case dht.unpublishDatumChan <- target:
+	case <-dht.stopChan:
+	}
+}
+
+// Returns information on all data being kept alive by this node. Returns nil
+// once the DHT has been stopped.
+func (dht *DHT) ListPublishedData() []PublishedDatumInfo {
+	if dht.isStopped() {
+		return nil
+	}
+
+	ch := make(chan []PublishedDatumInfo, 1)
+	select {
+	case dht.requestPublishedDataChan <- ch:
+	case <-dht.stopChan:
+		return nil
+	}
+
+	select {
+	case info := <-ch:
+		return info
+	case <-dht.stopChan:
+		return nil
+	}
+}
+
+// Returns information on all infohashes for which this node announces itself
+// as a peer. Returns nil once the DHT has been stopped.
+func (dht *DHT) ListAnnounces() []AnnounceInfo {
+	if dht.isStopped() {
+		return nil
+	}
+
+	ch := make(chan []AnnounceInfo, 1)
+	select {
+	case dht.requestAnnouncesChan <- ch:
+	case <-dht.stopChan:
+		return nil
+	}
+
+	select {
+	case info := <-ch:
+		return info
+	case <-dht.stopChan:
+		return nil
+	}
 }
 
 // Returns information on all known reachable nodes. Useful for saving the node
-// database to persistent storage.
+// database to persistent storage. Returns nil once the DHT has been stopped.
 func (dht *DHT) ListReachableNodes() []NodeInfo {
+	if dht.isStopped() {
+		return nil
+	}
+
 	ch := make(chan []NodeInfo, 1)
-	dht.requestReachableNodesChan <- ch
-	return <-ch
+	select {
+	case dht.requestReachableNodesChan <- ch:
+	case <-dht.stopChan:
+		return nil
+	}
+
+	select {
+	case info := <-ch:
+		return info
+	case <-dht.stopChan:
+		return nil
+	}
 }
 
-// Return the node ID.
+// Return the node ID. If the node ID was generated, it may change once our
+// external IP is known so as to conform to BEP 42.
 func (dht *DHT) NodeID() NodeID {
+	dht.stateMutex.RLock()
+	defer dht.stateMutex.RUnlock()
+
 	return dht.cfg.NodeID
 }
+
+// Returns our external IP as agreed by the nodes we have queried, or nil if
+// it is not yet known.
+func (dht *DHT) ExternalIP() net.IP {
+	dht.stateMutex.RLock()
+	defer dht.stateMutex.RUnlock()
+
+	return dht.externalIP
+}
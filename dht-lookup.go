@@ -0,0 +1,145 @@
+package dht
+
+import "time"
+
+// How long a lookup may run before it is finished with whatever responses
+// have been received.
+const lookupDuration = 30 * time.Second
+
+// l: Iterative lookups. {{{1
+
+// Identifies a lookup. Concurrent requests for the same method and target
+// share a lookup.
+type lookupKey struct {
+	method string
+	target InfoHash
+}
+
+// Start a lookup using the given nodes from the routing table, or add them to
+// the lookup already in progress for the method and target.
+func (dht *DHT) lStartLookup(method string, target InfoHash, seeds []*node) {
+	key := lookupKey{method, target}
+	l, ok := dht.lookups[key]
+	if !ok {
+		l = newLookup(method, target, dht.cfg.Clock.Now())
+		dht.lookups[key] = l
+	}
+
+	for _, n := range seeds {
+		l.add(n, 1)
+	}
+
+	dht.lAdvanceLookup(l)
+}
+
+// Send queries to the closest candidates not yet queried, or finish the lookup
+// if it has converged.
+func (dht *DHT) lAdvanceLookup(l *lookup) {
+	if l.converged() {
+		dht.lFinishLookup(l)
+		return
+	}
+
+	for _, c := range l.next(dht.cfg.LookupConcurrency) {
+		dht.lTxLookupQuery(l, c.n)
+	}
+
+	if l.numInState(lookupCandidateQueried) == 0 {
+		// Nothing in flight and nobody left to ask.
+		dht.lFinishLookup(l)
+	}
+}
+
+// Send the query appropriate to the lookup to a node.
+func (dht *DHT) lTxLookupQuery(l *lookup, n *node) {
+	switch l.method {
+	case "find_node":
+		dht.lTxFindNode(n, NodeID(l.target))
+		n.MarkContacted(dht.cfg.Clock, l.target)
+	case "get_peers":
+		dht.lRequestPeersFrom(n, l.target)
+	case "get":
+		var seq *uint64
+		if ds, ok := dht.datumSearches[l.target]; ok {
+			seq = ds.seq
+		}
+		dht.lTxGet(n, l.target, seq)
+	}
+}
+
+// Called from RX when a node responds to a lookup query with the given closer
+// nodes and, for get_peers and get, a write token.
+func (dht *DHT) lLookupResponse(method string, target InfoHash, n *node, nodes []*node, token []byte) {
+	l, ok := dht.lookups[lookupKey{method, target}]
+	if !ok {
+		return
+	}
+
+	c := l.responded(n)
+	if c == nil {
+		return
+	}
+
+	c.token = token
+	for _, nn := range nodes {
+		l.add(nn, c.depth+1)
+	}
+
+	dht.lAdvanceLookup(l)
+}
+
+// Called when a lookup query to a node has failed.
+func (dht *DHT) lLookupQueryFailed(method string, target InfoHash, n *node) {
+	l, ok := dht.lookups[lookupKey{method, target}]
+	if !ok {
+		return
+	}
+
+	l.failed(n)
+	dht.lAdvanceLookup(l)
+}
+
+// Finish any lookups which have run for too long, such as those waiting on
+// queries which will never be answered. Called periodically.
+func (dht *DHT) lExpireLookups() {
+	now := dht.cfg.Clock.Now()
+	for _, l := range dht.lookups {
+		if now.Sub(l.startTime) > lookupDuration {
+			dht.lFinishLookup(l)
+		}
+	}
+}
+
+// Conclude a lookup and report its statistics. Responses to queries still in
+// flight are processed as usual, but do not lead to further queries.
+func (dht *DHT) lFinishLookup(l *lookup) {
+	key := lookupKey{l.method, l.target}
+	if dht.lookups[key] != l {
+		return
+	}
+
+	delete(dht.lookups, key)
+
+	res := LookupResult{
+		Method:       l.method,
+		Target:       l.target,
+		Hops:         l.hops,
+		NumQueried:   l.numQueried,
+		NumResponded: l.numResponded,
+		Duration:     dht.cfg.Clock.Now().Sub(l.startTime),
+	}
+	log.Debugf("cl(%v) lookup finished %+v", dht.cfg.NodeID.ShortString(), res)
+
+	select {
+	case dht.lookupChan <- res:
+	default:
+		// The client is not keeping up.
+	}
+
+	switch l.method {
+	case "get_peers":
+		dht.lPeersLookupFinished(l)
+	case "get":
+		dht.lDatumLookupFinished(l.target)
+	}
+}
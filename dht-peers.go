@@ -0,0 +1,89 @@
+package dht
+
+import "net"
+
+// A caller of GetPeers awaiting peers for an infohash.
+type peerSubscription struct {
+	infoHash InfoHash
+	queue    *peerQueue
+
+	// Addresses already delivered, so that each is delivered only once.
+	sent map[string]struct{}
+}
+
+type getPeersInfo struct {
+	Sub      *peerSubscription
+	Announce bool
+	Port     int
+}
+
+// l: Per-call peer searching. {{{1
+
+// Called via channel from client. Delivers the peers already known for the
+// infohash and starts a lookup for more. The subscription ends when the lookup
+// does.
+func (dht *DHT) lGetPeers(gpi getPeersInfo) {
+	sub := gpi.Sub
+	dht.peerSubs[sub.infoHash] = append(dht.peerSubs[sub.infoHash], sub)
+
+	for _, addr := range dht.peersFor(sub.infoHash) {
+		dht.lDeliverPeer(sub, addr)
+	}
+
+	if gpi.Announce {
+		addHolder(dht.announceHolders, sub.infoHash, nil)
+		dht.lSetLocallyOriginated(sub.infoHash, true, gpi.Port)
+	}
+
+	closest := dht.neighbourhood.routingTable.LookupFiltered(sub.infoHash, dht.lRecontactFilterPredicate)
+	dht.lStartLookup("get_peers", sub.infoHash, closest)
+}
+
+// Called from RX when a node returns peers for an infohash.
+func (dht *DHT) lPeersFound(infoHash InfoHash, addrs []net.UDPAddr) {
+	for _, sub := range dht.peerSubs[infoHash] {
+		for _, addr := range addrs {
+			dht.lDeliverPeer(sub, addr)
+		}
+	}
+}
+
+// Deliver a peer to a subscriber unless it has already been delivered.
+func (dht *DHT) lDeliverPeer(sub *peerSubscription, addr net.UDPAddr) {
+	key := addr.String()
+	if _, ok := sub.sent[key]; ok {
+		return
+	}
+
+	sub.sent[key] = struct{}{}
+	sub.queue.Push(PeerResult{InfoHash: sub.infoHash, Addr: addr})
+}
+
+// End all subscriptions for an infohash once the peers queued for them have
+// been delivered. Called when its lookup finishes.
+func (dht *DHT) lEndPeerSubscriptions(infoHash InfoHash) {
+	for _, sub := range dht.peerSubs[infoHash] {
+		sub.queue.End()
+	}
+
+	delete(dht.peerSubs, infoHash)
+}
+
+// Called via channel from client when a subscription's context is cancelled.
+// The client aborts the queue itself.
+func (dht *DHT) lCancelPeerSubscription(sub *peerSubscription) {
+	subs := dht.peerSubs[sub.infoHash]
+	for i, s := range subs {
+		if s != sub {
+			continue
+		}
+
+		subs = append(subs[:i], subs[i+1:]...)
+		if len(subs) == 0 {
+			delete(dht.peerSubs, sub.infoHash)
+		} else {
+			dht.peerSubs[sub.infoHash] = subs
+		}
+		return
+	}
+}
@@ -0,0 +1,111 @@
+package dht
+
+import "time"
+
+// A datum which this node has put and which it keeps alive by periodically
+// putting it again.
+type publishedDatum struct {
+	datum *Datum
+
+	// When the most recent get/put cycle was started.
+	lastAttempt time.Time
+
+	// When a node last accepted the datum.
+	lastStored time.Time
+
+	// Number of nodes which accepted the datum in the most recent cycle.
+	numStored int
+
+	// The most recent error with which a node rejected the datum, if any.
+	lastError error
+}
+
+// l: Datum publishing. {{{1
+
+// Called via channel from client. Remembers the datum and starts a get/put
+// cycle for it. A datum with the same target as one already published replaces
+// it.
+func (dht *DHT) lPublishDatum(datum *Datum) {
+	target := datum.target()
+
+	pd, ok := dht.published[target]
+	if !ok {
+		pd = &publishedDatum{}
+		dht.published[target] = pd
+	}
+
+	pd.datum = datum
+	dht.lRepublishDatum(target, pd)
+}
+
+func (dht *DHT) lRepublishDatum(target InfoHash, pd *publishedDatum) {
+	pd.lastAttempt = dht.cfg.Clock.Now()
+	dht.lRequestDatum(requestDatumInfo{
+		Target: target,
+		Datum:  pd.datum,
+	})
+}
+
+// Called via channel from client. Stops republishing the datum with the given
+// target. The datum will expire from the DHT in due course.
+func (dht *DHT) lUnpublishDatum(target InfoHash) {
+	delete(dht.published, target)
+}
+
+// Republish any data for which the republish period has elapsed. Called
+// periodically.
+func (dht *DHT) lRepublishData() {
+	now := dht.cfg.Clock.Now()
+	for target, pd := range dht.published {
+		if now.Sub(pd.lastAttempt) >= dht.cfg.RepublishPeriod {
+			dht.lRepublishDatum(target, pd)
+		}
+	}
+}
+
+// Called when put queries are about to be sent for a datum.
+func (dht *DHT) lDatumPutStarted(target InfoHash, datum *Datum) {
+	pd, ok := dht.published[target]
+	if !ok || pd.datum != datum {
+		return
+	}
+
+	pd.numStored = 0
+}
+
+// Called from RX when a node accepts a put.
+func (dht *DHT) lDatumStored(target InfoHash, datum *Datum) {
+	pd, ok := dht.published[target]
+	if !ok || pd.datum.SequenceNo != datum.SequenceNo {
+		return
+	}
+
+	pd.lastStored = dht.cfg.Clock.Now()
+	pd.numStored++
+}
+
+// Called when a node fails to store a datum.
+func (dht *DHT) lDatumPutFailed(target InfoHash, datum *Datum, err error) {
+	pd, ok := dht.published[target]
+	if !ok || pd.datum.SequenceNo != datum.SequenceNo || err == errQueryTimeout {
+		return
+	}
+
+	pd.lastError = err
+}
+
+func (dht *DHT) lListPublishedData() []PublishedDatumInfo {
+	var info []PublishedDatumInfo
+
+	for target, pd := range dht.published {
+		info = append(info, PublishedDatumInfo{
+			Target:     target,
+			Datum:      pd.datum,
+			LastStored: pd.lastStored,
+			NumStored:  pd.numStored,
+			LastError:  pd.lastError,
+		})
+	}
+
+	return info
+}
@@ -1,10 +1,9 @@
 package dht
 
 import (
-	"crypto/sha1"
+	"bytes"
 	"fmt"
 	"github.com/hlandau/dht/krpc"
-	"github.com/hlandau/eddsa"
 	"net"
 )
 
@@ -12,6 +11,12 @@ import (
 func (dht *DHT) lRxPacket(data []byte, addr net.UDPAddr) error {
 	msg, err := krpc.Decode(data)
 	if err != nil {
+		if kerr, ok := err.(*krpc.Error); ok && msg != nil {
+			// A query we cannot handle; tell the sender so that it need not wait
+			// for a response.
+			dht.lTxError(addr, msg, kerr)
+		}
+
 		log.Noticee(err, "rx ignore (cannot decode)")
 		return err
 	}
@@ -37,6 +42,11 @@ func (dht *DHT) lRxPacket(data []byte, addr net.UDPAddr) error {
 
 // Handle an incoming query-type packet.
 func (dht *DHT) lRxQuery(msg *krpc.Message, addr net.UDPAddr) error {
+	if args, ok := msg.Args.(krQueryArgs); !ok || !args.Valid() {
+		dht.lTxError(addr, msg, krpc.NewError(krpc.ErrorCodeProtocol, "invalid arguments"))
+		return nil
+	}
+
 	nodeID, err := dht.lRxCheckNodeID(msg)
 	if err != nil {
 		log.Errore(err, "cl lRxCheckNodeID ", &addr)
@@ -95,7 +105,7 @@ func (dht *DHT) lRxGetPeersReq(v *krGetPeersReq, msg *krpc.Message, addr net.UDP
 	if len(peers) > 0 {
 		res.Endpoints = formPeerList(peers, v.Want, addr)
 	} else {
-		neighbours := dht.neighbourhood.routingTable.routingTree.Lookup(v.InfoHash)
+		neighbours := dht.neighbourhood.routingTable.Lookup(v.InfoHash)
 		res.Nodes, res.Nodes6 = formNodeList(neighbours, v.Want, addr)
 	}
 
@@ -111,7 +121,7 @@ func (dht *DHT) lRxFindNodeReq(v *krFindNodeReq, msg *krpc.Message, addr net.UDP
 		ID: dht.cfg.NodeID,
 	}
 
-	neighbours := dht.neighbourhood.routingTable.routingTree.Lookup(ihTarget)
+	neighbours := dht.neighbourhood.routingTable.Lookup(ihTarget)
 	res.Nodes, res.Nodes6 = formNodeList(neighbours, v.Want, addr)
 
 	dht.lTxResponse(addr, msg, res)
@@ -127,12 +137,24 @@ func (dht *DHT) lRxGetReq(v *krGetReq, msg *krpc.Message, addr net.UDPAddr) erro
 		Token: dht.tokenStore.Generate(addr),
 	}
 
-	neighbours := dht.neighbourhood.routingTable.routingTree.Lookup(v.Target)
+	neighbours := dht.neighbourhood.routingTable.Lookup(v.Target)
 	res.Nodes, res.Nodes6 = formNodeList(neighbours, wantAll, addr)
 
-	datum := dht.peerStore.Datum(v.Target)
-	if datum != nil {
+	datum := dht.datumStore.Get(v.Target, dht.cfg.Clock.Now())
+	if datum != nil && !datum.IsMutable() {
 		res.Value = datum.Value
+	} else if datum != nil {
+		// Mutable values must be returned with the information needed to verify
+		// them. If the requester already has this sequence number or a newer one,
+		// only the sequence number is returned.
+		res.Key = datum.Key
+		res.SequenceNo = new(uint64)
+		*res.SequenceNo = datum.SequenceNo
+
+		if v.Seq == nil || *v.Seq < datum.SequenceNo {
+			res.Value = datum.Value
+			res.Signature = datum.Signature
+		}
 	}
 
 	dht.lTxResponse(addr, msg, res)
@@ -153,10 +175,10 @@ func (dht *DHT) lRxAnnouncePeerReq(v *krAnnouncePeerReq, msg *krpc.Message, addr
 		n.LastRxTime = dht.cfg.Clock.Now().Add(-dht.cfg.SearchRetryPeriod) // TODO: check this
 
 		if _, ok := dht.locallyInterested[v.InfoHash]; ok {
-			dht.peersChan <- PeerResult{
+			dht.peersQueue.Push(PeerResult{
 				InfoHash: v.InfoHash,
-				Addr:     addr,
-			}
+				Addr:     announceAddr,
+			})
 		}
 	}
 
@@ -168,12 +190,13 @@ func (dht *DHT) lRxAnnouncePeerReq(v *krAnnouncePeerReq, msg *krpc.Message, addr
 	return nil
 }
 
+// Maximum length of a bencoded datum value.
 const maxPutLen = 1000
 
 // Handle an incoming put query.
 func (dht *DHT) lRxPutReq(v *krPutReq, msg *krpc.Message, addr net.UDPAddr) error {
 	if !dht.tokenStore.Verify(v.Token, addr) {
-		dht.lTxError(addr, msg, 203, "bad token")
+		dht.lTxError(addr, msg, krpc.NewError(krpc.ErrorCodeProtocol, "bad token"))
 		return nil
 	}
 
@@ -185,70 +208,48 @@ func (dht *DHT) lRxPutReq(v *krPutReq, msg *krpc.Message, addr net.UDPAddr) erro
 	}
 
 	if len(datum.Value) > maxPutLen {
-		dht.lTxError(addr, msg, 205, "value too large")
+		dht.lTxError(addr, msg, krpc.NewError(krpc.ErrorCodeValueTooLarge, ""))
 		return nil
 	}
 
-	if len(datum.Salt) > 64 {
-		dht.lTxError(addr, msg, 207, "salt too large")
+	if len(datum.Salt) > maxSaltLen {
+		dht.lTxError(addr, msg, krpc.NewError(krpc.ErrorCodeSaltTooLarge, ""))
 		return nil
 	}
 
-	if !datum.IsMutable() {
-		// The immutable case is simple.
-		h := sha1.New()
-		h.Write([]byte(fmt.Sprintf("%d:", len(datum.Value)) + datum.Value))
-		target := InfoHash(string(h.Sum(nil)))
-
-		dht.peerStore.AddDatum(target, datum)
-	} else {
-		// Mutable case.
+	target := datum.target()
 
+	if datum.IsMutable() {
 		if v.SequenceNo != nil {
 			datum.SequenceNo = *v.SequenceNo
 		}
 
-		// Yes, it really is the case that mutable keys are hashed using the raw
-		// Ed25519 public key+salt whereas immutable keys are hashed using a
-		// bencoded value.
-		h := sha1.New()
-		h.Write([]byte(datum.Key))
-		h.Write(datum.Salt)
-		keyTarget := InfoHash(string(h.Sum(nil)))
-
-		oldDatum := dht.peerStore.Datum(keyTarget)
+		oldDatum := dht.datumStore.Get(target, dht.cfg.Clock.Now())
 		if oldDatum != nil {
-			if oldDatum.SequenceNo >= datum.SequenceNo {
-				dht.lTxError(addr, msg, 302, "sequence number rollback not permitted")
+			// BEP 44: putting the same value again with the same sequence number
+			// only resets the timeout.
+			if oldDatum.SequenceNo > datum.SequenceNo ||
+				(oldDatum.SequenceNo == datum.SequenceNo && !bytes.Equal(oldDatum.Value, datum.Value)) {
+				dht.lTxError(addr, msg, krpc.NewError(krpc.ErrorCodeSequenceNumber, ""))
 				return nil
 			}
 
 			if v.CAS != nil && *v.CAS != oldDatum.SequenceNo {
-				dht.lTxError(addr, msg, 301, "CAS mismatch")
+				dht.lTxError(addr, msg, krpc.NewError(krpc.ErrorCodeCASMismatch, ""))
 				return nil
 			}
 		}
 
-		tbs := fmt.Sprintf("3:seqi%de1:v%d:", datum.SequenceNo, len(v.Value)) + v.Value
-		if len(v.Salt) > 0 {
-			tbs = fmt.Sprintf("4:salt%d:", len(v.Salt)) + string(v.Salt) + tbs
-		}
-
-		if len(datum.Signature) != 64 || len(datum.Key) != 32 {
-			dht.lTxError(addr, msg, 206, "bad signature")
+		if !datum.verifySignature() {
+			dht.lTxError(addr, msg, krpc.NewError(krpc.ErrorCodeInvalidSignature, ""))
 			return nil
 		}
+	}
 
-		publicKey := eddsa.PublicKey{
-			Curve: eddsa.Ed25519(),
-			X:     []byte(datum.Key),
-		}
-		if !publicKey.Verify([]byte(tbs), []byte(datum.Signature)) {
-			dht.lTxError(addr, msg, 206, "bad signature")
-			return nil
-		}
-
-		dht.peerStore.AddDatum(keyTarget, datum)
+	err := dht.datumStore.Put(target, datum, addr.IP, dht.cfg.Clock.Now())
+	if err != nil {
+		dht.lTxError(addr, msg, krpc.NewError(krpc.ErrorCodeServer, err.Error()))
+		return nil
 	}
 
 	n, _ := dht.neighbourhood.routingTable.Node(v.ID, addr)
@@ -291,7 +292,7 @@ func (dht *DHT) lRxResponse(msg *krpc.Message, addr net.UDPAddr) error {
 	}
 
 	// Ensure this is a response to a query we issued.
-	q, ok := n.PendingQueries[msg.TxID]
+	pq, ok := n.PendingQueries[msg.TxID]
 	if !ok {
 		// Unknown query.
 		return nil
@@ -300,26 +301,55 @@ func (dht *DHT) lRxResponse(msg *krpc.Message, addr net.UDPAddr) error {
 	// Don't accept duplicate responses.
 	defer delete(n.PendingQueries, msg.TxID)
 
+	q := pq.Query
+
 	// Interpret method-specific response information.
+	var nodeID NodeID
 	err = msg.ResponseAsMethod(q.Method)
+	if err == nil {
+		nodeID, err = dht.lRxCheckNodeID(msg)
+	}
 	if err != nil {
+		// An unusable response fails the query, as a timeout would, so that
+		// lookups waiting on it can proceed.
+		delete(n.PendingQueries, msg.TxID)
+		n.NumFailures++
+		dht.lQueryFailed(n, pq, err)
 		return err
 	}
 
-	nodeID, err := dht.lRxCheckNodeID(msg)
-	if err != nil {
-		return err
+	n.NumFailures = 0
+	n.NumErrors = 0
+
+	// Only sample the RTT of queries which were not retransmitted, since it
+	// cannot be known which transmission a response is for.
+	if pq.NumRetransmits == 0 {
+		n.AddRTTSample(dht.cfg.Clock.Now().Sub(pq.SentTime))
 	}
 
+	wasReachable := n.IsReachable()
+	n.LastRxTime = dht.cfg.Clock.Now()
+
 	if !n.NodeID.Valid() {
+		if !dht.lAcceptsNodeID(addr.IP, nodeID) {
+			// Not permitted under BEP 42.
+			dht.neighbourhood.Remove(n)
+			return nil
+		}
+
 		// We didn't already have the NodeID, set it.
 		n.NodeID = nodeID
 		dht.neighbourhood.routingTable.Update(n)
 	} else if n.NodeID != nodeID {
 		// Changed ID. TODO
+	} else if !wasReachable {
+		// First response; the node is now verified.
+		dht.neighbourhood.routingTable.Update(n)
 	}
 
-	n.LastRxTime = dht.cfg.Clock.Now()
+	if msg.IP.IP != nil {
+		dht.lExternalAddrReported(addr, net.UDPAddr(msg.IP))
+	}
 
 	dht.neighbourhood.Upkeep(n)
 	if dht.needMoreNodes() {
@@ -364,71 +394,145 @@ func (dht *DHT) lRxPingRes(v *krPing, msg *krpc.Message, addr net.UDPAddr) error
 }
 
 // Process another node's response to a get_peers query. If the response contains peers,
-// return them to the client. If it contains closer nodes, query them. Announce ourselves
-// as a peer if applicable.
+// return them to any GetPeers callers, and on PeersChan if we are still interested. If
+// it contains closer nodes, the lookup queries them.
 func (dht *DHT) lRxGetPeersRes(v *krGetPeersRes, msg *krpc.Message, addr net.UDPAddr) error {
 	n, _ := dht.neighbourhood.routingTable.Node("", addr)
 	//log.Debugf("cl(%v) lRxGetPeersRes %#v", dht.cfg.NodeID.ShortString(), n.PendingQueries[msg.TxID])
-	q := n.PendingQueries[msg.TxID].Args.(*krGetPeersReq)
+	q := n.PendingQueries[msg.TxID].Query.Args.(*krGetPeersReq)
 	// We know p and q exist because these were checked earlier.
 
 	infoHash := q.InfoHash
-	if _, ok := dht.locallyOriginated[infoHash]; ok {
-		dht.lTxAnnouncePeer(n, q.InfoHash, v.Token)
-	}
+	nodes := append(dht.lReceivedNodes(v.Nodes, addr), dht.lReceivedNodes(v.Nodes6, addr)...)
 
 	if v.Endpoints != nil {
-		var newEndpoints []net.UDPAddr
+		var endpoints, newEndpoints []net.UDPAddr
 		for _, endpoint := range v.Endpoints {
+			endpoints = append(endpoints, net.UDPAddr(endpoint))
 			inserted := dht.peerStore.Add(infoHash, net.UDPAddr(endpoint))
 			if inserted {
 				newEndpoints = append(newEndpoints, net.UDPAddr(endpoint))
 			}
 		}
 
-		for _, e := range newEndpoints {
-			// Put results on channel.
-			dht.peersChan <- PeerResult{
-				InfoHash: infoHash,
-				Addr:     e,
+		dht.lPeersFound(infoHash, endpoints)
+
+		if _, ok := dht.locallyInterested[infoHash]; ok {
+			for _, e := range newEndpoints {
+				// Put results on channel.
+				dht.peersQueue.Push(PeerResult{
+					InfoHash: infoHash,
+					Addr:     e,
+				})
 			}
 		}
 	}
 
+	dht.lLookupResponse("get_peers", infoHash, n, nodes, v.Token)
 	return nil
 }
 
 // Handle an incoming find_node response.
 func (dht *DHT) lRxFindNodeRes(v *krFindNodeRes, msg *krpc.Message, addr net.UDPAddr) error {
-	dht.neighbourhood.routingTable.Node(v.ID, addr)
-
-	dht.lReceivedNodes(v.Nodes, addr)
-	dht.lReceivedNodes(v.Nodes6, addr)
+	n, _ := dht.neighbourhood.routingTable.Node(v.ID, addr)
+	q := n.PendingQueries[msg.TxID].Query.Args.(*krFindNodeReq)
+	// We know n and q exist because these were checked earlier.
 
+	nodes := append(dht.lReceivedNodes(v.Nodes, addr), dht.lReceivedNodes(v.Nodes6, addr)...)
+	dht.lLookupResponse("find_node", InfoHash(q.Target), n, nodes, nil)
 	return nil
 }
 
+// Handle an incoming get response. The response is passed to the datum search
+// for the target, if one is still in progress.
 func (dht *DHT) lRxGetRes(v *krGetRes, msg *krpc.Message, addr net.UDPAddr) error {
-	// TODO
+	n, _ := dht.neighbourhood.routingTable.Node("", addr)
+	q := n.PendingQueries[msg.TxID].Query.Args.(*krGetReq)
+	// We know n and q exist because these were checked earlier.
+
+	nodes := append(dht.lReceivedNodes(v.Nodes, addr), dht.lReceivedNodes(v.Nodes6, addr)...)
+
+	dht.lDatumResponse(q.Target, n, v)
+	dht.lLookupResponse("get", q.Target, n, nodes, v.Token)
 	return nil
 }
 
-// Handle an incoming announce_peer response. No-op.
+// Handle an incoming announce_peer response. Records that the node accepted
+// the announcement.
 func (dht *DHT) lRxAnnouncePeerRes(v *krAnnouncePeerRes, msg *krpc.Message, addr net.UDPAddr) error {
-	// Nothing to do.
+	n, _ := dht.neighbourhood.routingTable.Node("", addr)
+	pq := n.PendingQueries[msg.TxID]
+	q := pq.Query.Args.(*krAnnouncePeerReq)
+	// We know n and q exist because these were checked earlier.
+
+	dht.lAnnounceAccepted(q.InfoHash, pq.Announce)
 	return nil
 }
 
-// Handle an incoming put response. No-op.
+// Handle an incoming put response. Records that the node stored the datum.
 func (dht *DHT) lRxPutRes(v *krPutRes, msg *krpc.Message, addr net.UDPAddr) error {
-	// Nothing to do.
+	n, _ := dht.neighbourhood.routingTable.Node("", addr)
+	q := n.PendingQueries[msg.TxID].Query.Args.(*krPutReq)
+	// We know n and q exist because these were checked earlier.
+
+	datum := q.datum()
+	dht.lDatumStored(datum.target(), datum)
 	return nil
 }
 
 // Rx error. {{{2
 
-// Handle an incoming error. No-op.
+// Handle an incoming error. The query it is in response to is failed with the
+// error.
 func (dht *DHT) lRxError(msg *krpc.Message, addr net.UDPAddr) error {
-	// Nothing to do.
+	n := dht.neighbourhood.routingTable.FindByAddress(addr)
+	if n == nil {
+		return nil
+	}
+
+	pq, ok := n.PendingQueries[msg.TxID]
+	if !ok {
+		// Unknown query.
+		return nil
+	}
+
+	delete(n.PendingQueries, msg.TxID)
+
+	// The node is responsive, but errors count against it.
+	n.LastRxTime = dht.cfg.Clock.Now()
+	n.NumFailures = 0
+	n.NumErrors++
+
+	// Decoding has already ensured msg.Error is set.
+	err := msg.Error
+	dht.lQueryFailed(n, pq, err)
+
+	qe := QueryError{
+		Method: pq.Query.Method,
+		Node: NodeLocator{
+			NodeID: n.NodeID,
+			Addr:   n.Addr,
+		},
+		Err: err,
+	}
+	switch v := pq.Query.Args.(type) {
+	case *krGetPeersReq:
+		qe.Target = v.InfoHash
+	case *krAnnouncePeerReq:
+		qe.Target = v.InfoHash
+	case *krGetReq:
+		qe.Target = v.Target
+	case *krPutReq:
+		qe.Target = v.datum().target()
+	case *krFindNodeReq:
+		qe.Target = InfoHash(v.Target)
+	}
+
+	select {
+	case dht.queryErrorChan <- qe:
+	default:
+		// The client is not keeping up.
+	}
+
 	return nil
 }
@@ -1,13 +1,23 @@
 package dht
 
 import (
+	"errors"
 	denet "github.com/hlandau/degoutils/net"
 	"github.com/hlandau/dht/krpc"
 	"net"
+	"time"
 )
 
-// Ping an address. Node ID is optional.
+// The error with which a query fails if no response is received.
+var errQueryTimeout = errors.New("query timed out")
+
+// Ping an address. Node ID is optional. Nodes not permitted under BEP 42 are
+// not pinged.
 func (dht *DHT) lTxPingAddr(addr net.UDPAddr, nodeID NodeID) error {
+	if nodeID.Valid() && !dht.lAcceptsNodeID(addr.IP, nodeID) {
+		return nil
+	}
+
 	n, _ := dht.neighbourhood.routingTable.Node(nodeID, addr)
 	return dht.lTxPing(n)
 }
@@ -36,23 +46,42 @@ func (dht *DHT) lTxGetPeers(n *node, infoHash InfoHash) error {
 	})
 }
 
-// Send a get command to a node.
-func (dht *DHT) lTxGet(n *node, target InfoHash) error {
+// Send a get command to a node. If seq is set, mutable values are only
+// requested if they are newer than it.
+func (dht *DHT) lTxGet(n *node, target InfoHash, seq *uint64) error {
 	return dht.lTxQuery(n, "get", &krGetReq{
 		ID:     dht.cfg.NodeID,
 		Target: target,
+		Seq:    seq,
 	})
 }
 
-// Send an announce_peer command to a node.
-func (dht *DHT) lTxAnnouncePeer(n *node, infoHash InfoHash, token []byte) error {
-	return dht.lTxQuery(n, "announce_peer", &krAnnouncePeerReq{
-		ID:          dht.cfg.NodeID,
-		InfoHash:    infoHash,
-		Token:       token,
-		ImpliedPort: 1,
-		Port:        0,
-	})
+// Send an announce_peer command to a node. If port is ImpliedPort, the node is
+// asked to use the source port of the query; the port of our socket is also
+// given for nodes which do not support implied_port.
+// The query is attributed to the given announcement.
+func (dht *DHT) lTxAnnouncePeer(n *node, a *announce, infoHash InfoHash, token []byte, port int) error {
+	req := &krAnnouncePeerReq{
+		ID:       dht.cfg.NodeID,
+		InfoHash: infoHash,
+		Token:    token,
+		Port:     port,
+	}
+
+	if port == ImpliedPort {
+		req.ImpliedPort = 1
+		if local, ok := dht.conn.LocalAddr().(*net.UDPAddr); ok {
+			req.Port = local.Port
+		}
+	}
+
+	pq, err := dht.lTxPendingQuery(n, "announce_peer", req)
+	if err != nil {
+		return err
+	}
+
+	pq.Announce = a
+	return nil
 }
 
 // Send a put command to a node.
@@ -77,18 +106,121 @@ func (dht *DHT) lTxPut(n *node, target InfoHash, token []byte, d *Datum) error {
 // Message writing.
 
 func (dht *DHT) lTxQuery(n *node, method string, args interface{}) error {
+	_, err := dht.lTxPendingQuery(n, method, args)
+	return err
+}
+
+// Send a query, returning the record of it which awaits a response.
+func (dht *DHT) lTxPendingQuery(n *node, method string, args interface{}) (*pendingQuery, error) {
 	q, err := krpc.MakeQuery(method, args)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	n.PendingQueries[q.TxID] = q
+	// The node may have been removed from the routing table since it was
+	// chosen, such as a lookup candidate displaced by closer nodes. The query is
+	// recorded against whichever node is now known at its address, so that the
+	// response is matched to it.
+	n, _ = dht.neighbourhood.routingTable.Node(n.NodeID, n.Addr)
+
+	now := dht.cfg.Clock.Now()
+	rto := n.RTO()
+	pq := &pendingQuery{
+		Query:          q,
+		Deadline:       now.Add(dht.queryTimeout(n)),
+		SentTime:       now,
+		RetransmitTime: now.Add(rto),
+		RTO:            rto,
+	}
+	n.PendingQueries[q.TxID] = pq
+	dht.queryingNodes[n] = struct{}{}
+
 	err = krpc.Write(dht.conn, n.Addr, q)
 	if err != nil && denet.ErrorIsPortUnreachable(err) {
 		dht.lNodeUnreachable(n)
 	}
 
-	return nil
+	return pq, nil
+}
+
+// Returns how long to wait for a response to a query to the node. If the node's
+// RTT is known, this allows for each retransmission with the timeout doubling,
+// up to QueryTimeout.
+func (dht *DHT) queryTimeout(n *node) time.Duration {
+	if n.RTT() == 0 {
+		return dht.cfg.QueryTimeout
+	}
+
+	rto := n.RTO()
+	timeout := rto
+	for i := 0; i < dht.cfg.MaxRetransmits; i++ {
+		rto *= 2
+		timeout += rto
+	}
+
+	if timeout > dht.cfg.QueryTimeout {
+		timeout = dht.cfg.QueryTimeout
+	}
+
+	return timeout
+}
+
+// Retransmit queries which have gone unanswered for longer than their
+// retransmission timeout, up to the retransmission limit, and time out those
+// which have gone unanswered past their deadline. Called periodically.
+func (dht *DHT) lExpireQueries() {
+	now := dht.cfg.Clock.Now()
+	for n := range dht.queryingNodes {
+		for txID, pq := range n.PendingQueries {
+			if now.Before(pq.Deadline) {
+				if !now.Before(pq.RetransmitTime) && pq.NumRetransmits < dht.cfg.MaxRetransmits {
+					dht.lRetransmitQuery(n, pq)
+				}
+				continue
+			}
+
+			log.Debugf("cl(%v) query timed out %v %v", dht.cfg.NodeID.ShortString(), pq.Query, &n.Addr)
+			delete(n.PendingQueries, txID)
+			n.NumFailures++
+			dht.lQueryFailed(n, pq, errQueryTimeout)
+		}
+
+		if len(n.PendingQueries) == 0 {
+			delete(dht.queryingNodes, n)
+		}
+	}
+}
+
+// Send a query again with the same transaction ID, so that a late response to
+// an earlier transmission will still be matched, and back off the timeout.
+func (dht *DHT) lRetransmitQuery(n *node, pq *pendingQuery) {
+	pq.NumRetransmits++
+	pq.RTO *= 2
+	pq.RetransmitTime = dht.cfg.Clock.Now().Add(pq.RTO)
+
+	err := krpc.Write(dht.conn, n.Addr, pq.Query)
+	if err != nil && denet.ErrorIsPortUnreachable(err) {
+		dht.lNodeUnreachable(n)
+	}
+}
+
+// Called when a query has timed out or been answered with an error. The
+// failure has already been counted against the node.
+func (dht *DHT) lQueryFailed(n *node, pq *pendingQuery, err error) {
+	q := pq.Query
+	switch v := q.Args.(type) {
+	case *krFindNodeReq:
+		dht.lLookupQueryFailed(q.Method, InfoHash(v.Target), n)
+	case *krGetPeersReq:
+		dht.lLookupQueryFailed(q.Method, v.InfoHash, n)
+	case *krGetReq:
+		dht.lLookupQueryFailed(q.Method, v.Target, n)
+	case *krAnnouncePeerReq:
+		dht.lAnnounceFailed(v.InfoHash, pq.Announce)
+	case *krPutReq:
+		datum := v.datum()
+		dht.lDatumPutFailed(datum.target(), datum, err)
+	}
 }
 
 // Respond to a given query message.
@@ -96,8 +228,9 @@ func (dht *DHT) lTxResponse(addr net.UDPAddr, q *krpc.Message, response interfac
 	return krpc.WriteResponse(dht.conn, addr, q, response)
 }
 
-func (dht *DHT) lTxError(addr net.UDPAddr, q *krpc.Message, errorCode int, errorMsg string) error {
-	return krpc.WriteError(dht.conn, addr, q, errorCode, errorMsg)
+// Respond to a given query message with an error.
+func (dht *DHT) lTxError(addr net.UDPAddr, q *krpc.Message, err *krpc.Error) error {
+	return krpc.WriteError(dht.conn, addr, q, err)
 }
 
 // Called when an address is deemed to be unreachable.
@@ -3,6 +3,7 @@ package dht
 import (
 	"github.com/hlandau/dht/krpc"
 	"github.com/hlandau/goutils/clock"
+	"math/rand"
 	"net"
 	"time"
 )
@@ -78,13 +79,34 @@ func timerAt(c clock.Clock, t time.Time) <-chan time.Time {
 	return c.After(t.Sub(c.Now()))
 }
 
-// Set whether an infohash is one we announce for.
-func (dht *DHT) lSetLocallyOriginated(infoHash InfoHash, announce bool) {
-	if announce {
-		dht.locallyOriginated[infoHash] = struct{}{}
-	} else {
-		delete(dht.locallyOriginated, infoHash)
+// Returns the duration randomly adjusted by up to a tenth either way, so that
+// periodic work for many items does not all fall due at once.
+func jitter(d time.Duration) time.Duration {
+	return d - d/10 + time.Duration(rand.Int63n(int64(d/5)+1))
+}
+
+// Add a holder of interest in, or of the announcement for, an infohash.
+// Holders are standing searches, or nil for the client's own requests.
+func addHolder(holders map[InfoHash]map[*search]struct{}, infoHash InfoHash, s *search) {
+	m, ok := holders[infoHash]
+	if !ok {
+		m = map[*search]struct{}{}
+		holders[infoHash] = m
 	}
+
+	m[s] = struct{}{}
+}
+
+// Remove a holder. Returns true iff no holders remain.
+func releaseHolder(holders map[InfoHash]map[*search]struct{}, infoHash InfoHash, s *search) bool {
+	m := holders[infoHash]
+	delete(m, s)
+	if len(m) > 0 {
+		return false
+	}
+
+	delete(holders, infoHash)
+	return true
 }
 
 func (dht *DHT) lSetLocallyInterested(infoHash InfoHash, interested bool) {
@@ -112,3 +134,9 @@ func (dht *DHT) needMorePeers(infoHash InfoHash) bool {
 func (dht *DHT) peersFor(infoHash InfoHash) []net.UDPAddr {
 	return dht.peerStore.Values(infoHash)
 }
+
+// Returns true iff a node at the given IP using the given node ID may be added
+// to the routing table under the configured BEP 42 policy.
+func (dht *DHT) lAcceptsNodeID(ip net.IP, nodeID NodeID) bool {
+	return dht.cfg.NodeIDPolicy != NodeIDPolicyEnforce || nodeIDIsSecure(ip, nodeID)
+}
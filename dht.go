@@ -1,11 +1,10 @@
 // Package dht implements a BitTorrent Mainline DHT node.
 //
-// Implements BEP-0005 and BEP-0032.
+// Implements BEP-0005, BEP-0032, BEP-0042 and BEP-0044.
 package dht
 
 import (
 	denet "github.com/hlandau/degoutils/net"
-	"github.com/hlandau/goutils/clock"
 	"github.com/hlandau/xlog"
 	"net"
 	"sync"
@@ -18,16 +17,32 @@ var log, Log = xlog.New("dht")
 // DHT structure, setup and teardown. {{{1
 
 type DHT struct {
+	// Number of peer and datum results discarded because the client was not
+	// keeping up. Accessed atomically, so kept first for alignment.
+	numDroppedPeers uint64
+	numDroppedData  uint64
+
 	cfg      Config
 	wantList []string
 
 	// Requests from the client.
 	addNodeChan               chan addNodeInfo
 	requestPeersChan          chan requestPeersInfo
+	requestDatumChan          chan requestDatumInfo
+	unpublishDatumChan        chan InfoHash
+	forgetChan                chan forgetInfo
+	getPeersChan              chan getPeersInfo
+	cancelGetPeersChan        chan *peerSubscription
 	requestReachableNodesChan chan chan<- []NodeInfo
+	requestPublishedDataChan  chan chan<- []PublishedDatumInfo
+	requestAnnouncesChan      chan chan<- []AnnounceInfo
 
 	// Channels to return information to the client.
-	peersChan chan PeerResult
+	peersQueue     *peerQueue
+	datumChan      chan DatumResult
+	queryErrorChan chan QueryError
+	lookupChan     chan LookupResult
+	announceChan   chan AnnounceResult
 
 	// Network traffic channels.
 	rxChan              chan packet
@@ -41,6 +56,11 @@ type DHT struct {
 	stopChan chan struct{}
 	stopOnce sync.Once
 	stopping uint32
+	loops    sync.WaitGroup // Goroutines which Stop waits for.
+
+	// Held while setting stopping, and while adding goroutines started for the
+	// client to loops, so that none is added once Stop has begun waiting.
+	loopsMutex sync.Mutex
 
 	// UDP TX/RX socket.
 	conn denet.UDPConn
@@ -48,26 +68,59 @@ type DHT struct {
 	// State.
 	neighbourhood     *neighbourhood
 	peerStore         *peerStore
+	datumStore        *datumStore
 	tokenStore        *tokenStore
-	locallyOriginated map[InfoHash]struct{}
+	locallyOriginated map[InfoHash]*originatedInfoHash
 	locallyInterested map[InfoHash]struct{}
+	interestHolders   map[InfoHash]map[*search]struct{}
+	announceHolders   map[InfoHash]map[*search]struct{}
+	datumSearches     map[InfoHash]*datumSearch
+	lookups           map[lookupKey]*lookup
+	peerSubs          map[InfoHash][]*peerSubscription
+	announces         map[InfoHash]*announce
+	published         map[InfoHash]*publishedDatum
+	ipVote            *ipVote
+
+	// Nodes which may have pending queries.
+	queryingNodes map[*node]struct{}
+
+	// Whether the node ID was generated rather than configured, in which case
+	// it may be changed to conform to our external IP.
+	nodeIDGenerated bool
+
+	// Guards writes to cfg.NodeID and externalIP, which are read by the client.
+	// Only the control loop writes them, so it may read them without locking.
+	stateMutex sync.RWMutex
+	externalIP net.IP
 }
 
 // Create a new DHT node and start it.
 func New(cfg *Config) (*DHT, error) {
+	nodeIDGenerated := !cfg.NodeID.Valid()
 	cfg.setDefaults()
 
 	dht := &DHT{
-		cfg: *cfg,
+		cfg:             *cfg,
+		nodeIDGenerated: nodeIDGenerated,
 
 		// Requests from the client.
 		stopChan:                  make(chan struct{}),
 		addNodeChan:               make(chan addNodeInfo, 10),
 		requestPeersChan:          make(chan requestPeersInfo, 10),
+		requestDatumChan:          make(chan requestDatumInfo, 10),
+		unpublishDatumChan:        make(chan InfoHash, 10),
+		forgetChan:                make(chan forgetInfo, 10),
+		getPeersChan:              make(chan getPeersInfo, 10),
+		cancelGetPeersChan:        make(chan *peerSubscription, 10),
 		requestReachableNodesChan: make(chan chan<- []NodeInfo, 10),
+		requestPublishedDataChan:  make(chan chan<- []PublishedDatumInfo, 10),
+		requestAnnouncesChan:      make(chan chan<- []AnnounceInfo, 10),
 
 		// Channels to return information to the client.
-		peersChan: make(chan PeerResult, 10),
+		datumChan:      make(chan DatumResult, 10),
+		queryErrorChan: make(chan QueryError, 10),
+		lookupChan:     make(chan LookupResult, 10),
+		announceChan:   make(chan AnnounceResult, 10),
 
 		// Network traffic channels.
 		rxChan:              make(chan packet, 10),
@@ -78,21 +131,28 @@ func New(cfg *Config) (*DHT, error) {
 		requestPingChan: make(chan *node, 10),
 
 		// State.
-		neighbourhood:     newNeighbourhood(cfg.NodeID),
-		peerStore:         newPeerStore(cfg.MaxInfoHashes, cfg.MaxInfoHashPeers),
+		neighbourhood: newNeighbourhood(cfg),
+		peerStore:     newPeerStore(cfg.MaxInfoHashes, cfg.MaxInfoHashPeers),
+		datumStore: newDatumStore(cfg.DatumLifetime, cfg.MaxDatumStorage,
+			cfg.MaxDatumsPerIP, cfg.MaxDatumsPerSubnet),
 		tokenStore:        newTokenStore(),
-		locallyOriginated: map[InfoHash]struct{}{},
+		locallyOriginated: map[InfoHash]*originatedInfoHash{},
 		locallyInterested: map[InfoHash]struct{}{},
+		interestHolders:   map[InfoHash]map[*search]struct{}{},
+		announceHolders:   map[InfoHash]map[*search]struct{}{},
+		datumSearches:     map[InfoHash]*datumSearch{},
+		lookups:           map[lookupKey]*lookup{},
+		peerSubs:          map[InfoHash][]*peerSubscription{},
+		announces:         map[InfoHash]*announce{},
+		published:         map[InfoHash]*publishedDatum{},
+		ipVote:            newIPVote(externalIPMaxReporters, externalIPMinVotes),
+		queryingNodes:     map[*node]struct{}{},
 	}
 
 	if dht.cfg.AnyPeerAF {
 		dht.wantList = []string{"n4", "n6"}
 	}
 
-	if dht.cfg.Clock == nil {
-		dht.cfg.Clock = clock.Real
-	}
-
 	// Create UDP socket.
 	var err error
 	if dht.cfg.ListenFunc != nil {
@@ -110,8 +170,11 @@ func New(cfg *Config) (*DHT, error) {
 		return nil, err
 	}
 
+	dht.peersQueue = newPeerQueue(dht.cfg.PeerQueueLen, dht.cfg.PeerQueueOverflow, &dht.numDroppedPeers)
+
 	// Start loops.
 	log.Debugf("(%v) starting", dht.cfg.NodeID.ShortString())
+	dht.loops.Add(2)
 	go dht.readLoop()
 	go dht.controlLoop()
 
@@ -128,20 +191,30 @@ type packet struct {
 // Reads datagrams from the connection and queues them for processing on the
 // l-goroutine.
 func (dht *DHT) readLoop() {
+	defer dht.loops.Done()
+
 	for {
 		b, addr, err := denet.ReadDatagramFromUDP(dht.conn)
 
 		switch {
 		// Successful receive.
 		case err == nil:
-			dht.rxChan <- packet{
+			select {
+			case dht.rxChan <- packet{
 				Data: b,
 				Addr: *addr,
+			}:
+			case <-dht.stopChan:
+				return
 			}
 
 			// An address was unreachable.
 		case denet.ErrorIsPortUnreachable(err):
-			dht.addrUnreachableChan <- *addr
+			select {
+			case dht.addrUnreachableChan <- *addr:
+			case <-dht.stopChan:
+				return
+			}
 
 			// Unless we are stopping, other errors should not occur.
 		case atomic.LoadUint32(&dht.stopping) == 0:
@@ -157,8 +230,20 @@ func (dht *DHT) readLoop() {
 // Main loop. Methods which are only to be run from this goroutine are named
 // "lFoo".
 func (dht *DHT) controlLoop() {
-	defer close(dht.peersChan) // notifies client that no more peers are forthcoming
-	defer dht.conn.Close()     // ensures the readLoop dies
+	defer dht.loops.Done()
+	defer dht.peersQueue.Abort() // notifies client that no more peers are forthcoming
+	defer close(dht.datumChan)   // likewise for data
+	defer close(dht.queryErrorChan)
+	defer close(dht.lookupChan)
+	defer close(dht.announceChan)
+	defer func() {
+		for _, subs := range dht.peerSubs {
+			for _, sub := range subs {
+				sub.queue.Abort()
+			}
+		}
+	}()
+	defer dht.conn.Close() // ensures the readLoop dies
 
 	// Ticker for the cleanup operation.
 	cleanupTicker := dht.cfg.Clock.NewTicker(dht.cfg.CleanupPeriod)
@@ -168,6 +253,27 @@ func (dht *DHT) controlLoop() {
 	tokenRotateTicker := dht.cfg.Clock.NewTicker(dht.cfg.TokenRotatePeriod)
 	defer tokenRotateTicker.Stop()
 
+	// Ticker for retransmitting and timing out unanswered queries.
+	queryTimeoutTicker := dht.cfg.Clock.NewTicker(minRTO / 2)
+	defer queryTimeoutTicker.Stop()
+
+	// Ticker for concluding datum searches and lookups which have timed out.
+	searchTimeoutTicker := dht.cfg.Clock.NewTicker(1 * time.Second)
+	defer searchTimeoutTicker.Stop()
+
+	// Ticker for republishing data.
+	republishTicker := dht.cfg.Clock.NewTicker(dht.cfg.RepublishPeriod / 4)
+	defer republishTicker.Stop()
+
+	// Ticker for announcing locally originated infohashes again, often enough
+	// to retry failed announcements promptly.
+	reannounceTickPeriod := dht.cfg.ReannouncePeriod / 16
+	if reannounceTickPeriod > reannounceRetryMin/2 {
+		reannounceTickPeriod = reannounceRetryMin / 2
+	}
+	reannounceTicker := dht.cfg.Clock.NewTicker(reannounceTickPeriod)
+	defer reannounceTicker.Stop()
+
 	// Service requests.
 	for {
 		select {
@@ -182,13 +288,47 @@ func (dht *DHT) controlLoop() {
 
 		case rpi := <-dht.requestPeersChan:
 			log.Debugf("cl(%v) requestPeers %v", dht.cfg.NodeID.ShortString(), rpi)
-			dht.lRequestPeers(rpi.InfoHash, rpi.Announce)
+			select {
+			case <-rpi.Cancel:
+				// Cancelled while queued, e.g. by stopping a search.
+			default:
+				dht.lRequestPeers(rpi.InfoHash, rpi.Announce, rpi.Port, rpi.Search)
+			}
+
+		case rdi := <-dht.requestDatumChan:
+			log.Debugf("cl(%v) requestDatum %v", dht.cfg.NodeID.ShortString(), rdi)
+			if rdi.Datum != nil {
+				dht.lPublishDatum(rdi.Datum)
+			} else {
+				dht.lRequestDatum(rdi)
+			}
+
+		case gpi := <-dht.getPeersChan:
+			log.Debugf("cl(%v) getPeers %v", dht.cfg.NodeID.ShortString(), gpi.Sub.infoHash)
+			dht.lGetPeers(gpi)
+
+		case sub := <-dht.cancelGetPeersChan:
+			dht.lCancelPeerSubscription(sub)
+
+		case fi := <-dht.forgetChan:
+			log.Debugf("cl(%v) forget %v", dht.cfg.NodeID.ShortString(), fi)
+			dht.lForget(fi.InfoHash, fi.Interest, fi.Search)
+
+		case target := <-dht.unpublishDatumChan:
+			log.Debugf("cl(%v) unpublishDatum %v", dht.cfg.NodeID.ShortString(), target)
+			dht.lUnpublishDatum(target)
 
 		case ch := <-dht.requestReachableNodesChan:
 			r := dht.lListReachableNodes()
 			log.Debugf("cl(%p) requestReachableNodes result=%v", dht, r)
 			ch <- r
 
+		case ch := <-dht.requestPublishedDataChan:
+			ch <- dht.lListPublishedData()
+
+		case ch := <-dht.requestAnnouncesChan:
+			ch <- dht.lListAnnounces()
+
 			// Network traffic.
 		case pkt := <-dht.rxChan:
 			err := dht.lRxPacket(pkt.Data, pkt.Addr)
@@ -218,6 +358,24 @@ func (dht *DHT) controlLoop() {
 			log.Debugf("cl tokenRotateTicker")
 			dht.tokenStore.Cycle()
 
+			// Periodically retransmit and time out unanswered queries.
+		case <-queryTimeoutTicker.C():
+			dht.lExpireQueries()
+
+			// Periodically conclude timed out datum searches and lookups.
+		case <-searchTimeoutTicker.C():
+			dht.lExpireDatumSearches()
+			dht.lExpireLookups()
+
+			// Periodically republish data put by this node.
+		case <-republishTicker.C():
+			log.Debugf("cl republishTicker")
+			dht.lRepublishData()
+
+			// Periodically announce locally originated infohashes again.
+		case <-reannounceTicker.C():
+			dht.lReannounceDue()
+
 			// Rate limiting...
 		}
 	}
@@ -258,6 +416,7 @@ func (dht *DHT) lListReachableNodes() []NodeInfo {
 				NodeID: n.NodeID,
 				Addr:   n.Addr,
 			},
+			RTT: n.RTT(),
 		})
 		return nil
 	})
@@ -267,12 +426,15 @@ func (dht *DHT) lListReachableNodes() []NodeInfo {
 
 // l: Peer searching. {{{1
 
-// Called via channel from client.
-func (dht *DHT) lRequestPeers(infoHash InfoHash, announce bool) error {
+// Called via channel from client. The interest, and announcement if any, are
+// held by the given search, or by the client if it is nil.
+func (dht *DHT) lRequestPeers(infoHash InfoHash, announce bool, port int, holder *search) error {
 	if announce {
-		dht.lSetLocallyOriginated(infoHash, announce)
+		addHolder(dht.announceHolders, infoHash, holder)
+		dht.lSetLocallyOriginated(infoHash, announce, port)
 	}
 
+	addHolder(dht.interestHolders, infoHash, holder)
 	dht.lSetLocallyInterested(infoHash, true)
 
 	if dht.needMorePeers(infoHash) {
@@ -282,15 +444,33 @@ func (dht *DHT) lRequestPeers(infoHash InfoHash, announce bool) error {
 	return nil
 }
 
-// Called when more peers are needed for an infohash. We already know we don't
-// have the maximum number.
-func (dht *DHT) lRequestPeersActual(infoHash InfoHash) error {
-	closest := dht.neighbourhood.routingTable.routingTree.LookupFiltered(infoHash, dht.lFilterPredicate)
+// Called via channel from client. The given search, or the client if it is
+// nil, stops holding the announcement for the infohash and, if interest is set,
+// its interest too. Announcing and searching stop once nothing holds them. A
+// lookup still awaited by GetPeers callers is left to finish.
+func (dht *DHT) lForget(infoHash InfoHash, interest bool, holder *search) {
+	if releaseHolder(dht.announceHolders, infoHash, holder) {
+		dht.lSetLocallyOriginated(infoHash, false, ImpliedPort)
+	}
+	if !interest || !releaseHolder(dht.interestHolders, infoHash, holder) {
+		return
+	}
+
+	dht.lSetLocallyInterested(infoHash, false)
+	if _, ok := dht.peerSubs[infoHash]; ok {
+		return
+	}
 
-	for _, n := range closest {
-		dht.lRequestPeersFrom(n, infoHash)
+	if l, ok := dht.lookups[lookupKey{"get_peers", infoHash}]; ok {
+		dht.lFinishLookup(l)
 	}
+}
 
+// Called when more peers are needed for an infohash. We already know we don't
+// have the maximum number.
+func (dht *DHT) lRequestPeersActual(infoHash InfoHash) error {
+	closest := dht.neighbourhood.routingTable.LookupFiltered(infoHash, dht.lFilterPredicate)
+	dht.lStartLookup("get_peers", infoHash, closest)
 	return nil
 }
 
@@ -300,7 +480,12 @@ func (dht *DHT) lRequestPeersFrom(n *node, infoHash InfoHash) {
 }
 
 func (dht *DHT) lFilterPredicate(infoHash InfoHash, n *node) bool {
-	return n.NodeID.Valid() && n.NumPendingQueries() < dht.cfg.MaxPendingQueries && !n.WasContactedRecently(infoHash, dht.cfg.SearchRetryPeriod)
+	return n.NodeID.Valid() && n.NumPendingQueries() < dht.cfg.MaxPendingQueries && !n.WasContactedRecently(infoHash, dht.cfg.SearchRetryPeriod, dht.cfg.Clock.Now())
+}
+
+// Like lFilterPredicate, but includes recently contacted nodes.
+func (dht *DHT) lRecontactFilterPredicate(infoHash InfoHash, n *node) bool {
+	return n.NodeID.Valid() && n.NumPendingQueries() < dht.cfg.MaxPendingQueries
 }
 
 // l: Node searching. {{{1
@@ -308,19 +493,18 @@ func (dht *DHT) lFilterPredicate(infoHash InfoHash, n *node) bool {
 // Called via channel to do further searchinng based on a node. Generated
 // internally from other work.
 func (dht *DHT) lProcRecurseNode(nodeID NodeID) error {
-	closest := dht.neighbourhood.routingTable.routingTree.LookupFiltered(InfoHash(nodeID), dht.lFilterPredicate)
-	for _, n := range closest {
-		dht.lTxFindNode(n, nodeID)
-		n.MarkContacted(dht.cfg.Clock, InfoHash(nodeID))
-	}
-
+	closest := dht.neighbourhood.routingTable.LookupFiltered(InfoHash(nodeID), dht.lFilterPredicate)
+	dht.lStartLookup("find_node", InfoHash(nodeID), closest)
 	return nil
 }
 
-// Called from RX when we are informed of new nodes.
-func (dht *DHT) lReceivedNodes(nodes []NodeLocator, originAddr net.UDPAddr) error {
+// Called from RX when we are informed of nodes. Nodes not already known are
+// added to the routing table. Returns the nodes which are acceptable, for
+// lookups to continue with.
+func (dht *DHT) lReceivedNodes(nodes []NodeLocator, originAddr net.UDPAddr) []*node {
+	var r []*node
 	for _, locator := range nodes {
-		if locator.NodeID == dht.cfg.NodeID {
+		if locator.NodeID == dht.cfg.NodeID || dht.lIsOwnAddr(locator.Addr) {
 			// Skip references to ourself.
 			continue
 		}
@@ -330,53 +514,45 @@ func (dht *DHT) lReceivedNodes(nodes []NodeLocator, originAddr net.UDPAddr) erro
 			continue
 		}
 
-		n, wasInserted := dht.neighbourhood.routingTable.Node(locator.NodeID, locator.Addr)
-		if !wasInserted {
-			// Duplicate.
+		if !isValidAddress(locator.Addr) || !dht.lAcceptsNodeID(locator.Addr.IP, locator.NodeID) {
+			// Unusable, or not permitted under BEP 42.
 			continue
 		}
 
-		if dht.needMoreNodes() {
-			select {
-			case dht.recurseNodeChan <- locator.NodeID:
-			default:
-				// Too many find_node commands queued. The peer has already been added
-				// to the routing table, so we're not losing any information.
-			}
-		}
-
-		dht.lRequestMorePeers(n) // TODO: check this
+		n, _ := dht.neighbourhood.routingTable.Node(locator.NodeID, locator.Addr)
+		r = append(r, n)
 	}
 
-	return nil
-}
-
-func (dht *DHT) lRequestMorePeers(n *node) {
-	for infoHash := range dht.locallyInterested {
-		if !dht.needMorePeers(infoHash) {
-			continue
-		}
-
-		dht.lRequestPeersFrom(n, infoHash)
-	}
+	return r
 }
 
 // l: Cleanup. {{{1
 
 // Run cleanup operations. Called periodically.
 func (dht *DHT) lCleanup() {
-	nodesToBePinged := dht.neighbourhood.Cleanup(dht.cfg.CleanupPeriod)
-	go dht.slowPingLoop(nodesToBePinged)
+	nodesToBePinged := dht.neighbourhood.Cleanup(dht.cfg.CleanupPeriod, dht.cfg.Clock.Now())
+	if len(nodesToBePinged) > 0 {
+		dht.loops.Add(1)
+		go dht.slowPingLoop(nodesToBePinged)
+	}
+
+	dht.datumStore.Expire(dht.cfg.Clock.Now())
 }
 
 // Runs in its own goroutine.
 func (dht *DHT) slowPingLoop(nodes []*node) {
+	defer dht.loops.Done()
+
 	duration := dht.cfg.CleanupPeriod - 1*time.Minute
 	perPingWait := duration / time.Duration(len(nodes))
 	startTime := dht.cfg.Clock.Now()
 
 	for i, n := range nodes {
-		dht.requestPingChan <- n
+		select {
+		case dht.requestPingChan <- n:
+		case <-dht.stopChan:
+			return
+		}
 
 		waitUntil := startTime.Add(perPingWait * time.Duration(i+1))
 
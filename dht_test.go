@@ -1,11 +1,19 @@
 package dht
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
 	"fmt"
 	denet "github.com/hlandau/degoutils/net"
 	"github.com/hlandau/degoutils/net/mocknet"
+	"github.com/hlandau/dht/krpc"
 	"github.com/hlandau/goutils/clock"
+	"github.com/hlandauf/bencode"
 	"net"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -23,18 +31,24 @@ func createDHT(inet *mocknet.Internet, cfg *Config) (*DHT, error) {
 	cfg2.ListenFunc = func(cfg *Config) (denet.UDPConn, error) {
 		return inet.ListenUDP("udp", mustResolve(cfg.Address))
 	}
-	cfg2.Clock = clock.Real
+	if cfg2.Clock == nil {
+		cfg2.Clock = clock.Real
+	}
 
 	return New(&cfg2)
 }
 
 // Makes n DHTs.
 func makeDHTs(inet *mocknet.Internet, n int) (dhts []*DHT, addrs []string, err error) {
+	return makeDHTsWithConfig(inet, n, Config{})
+}
+
+// Makes n DHTs with the given configuration. The address is filled in.
+func makeDHTsWithConfig(inet *mocknet.Internet, n int, cfg Config) (dhts []*DHT, addrs []string, err error) {
 	for i := 0; i < n; i++ {
 		a := fmt.Sprintf("1.2.3.%d:5555", i+1)
-		d, err := createDHT(inet, &Config{
-			Address: a,
-		})
+		cfg.Address = a
+		d, err := createDHT(inet, &cfg)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -52,6 +66,164 @@ func stopDHTs(dhts []*DHT) {
 	}
 }
 
+// Makes n DHTs connected in a chain a->b->c->d->e, and waits for their routing
+// tables to populate.
+func makeChain(t *testing.T, inet *mocknet.Internet, n int) (dhts []*DHT, addrs []string) {
+	return makeChainWithConfig(t, inet, n, Config{})
+}
+
+// Makes a chain of n DHTs with the given configuration.
+func makeChainWithConfig(t *testing.T, inet *mocknet.Internet, n int, cfg Config) (dhts []*DHT, addrs []string) {
+	dhts, addrs, err := makeDHTsWithConfig(inet, n, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < len(dhts)-1; i++ {
+		dhts[i].AddNode(NodeLocator{
+			Addr: *mustResolve(addrs[i+1]),
+		})
+	}
+
+	// The trie displaces its most distant neighbours, so need not hold a full
+	// bucket's worth of nodes.
+	want := n - 1
+	if want > kNodes/2 {
+		want = kNodes / 2
+	}
+
+	waitFor(t, "routing tables to populate", func() bool {
+		for _, d := range dhts {
+			if len(d.ListReachableNodes()) < want {
+				return false
+			}
+		}
+		return true
+	})
+
+	return
+}
+
+// Polls until f returns true, failing the test if it does not do so within
+// 10 seconds.
+func waitFor(t *testing.T, what string, f func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !f() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// A clock which only moves when advanced by the test, so that timer-driven
+// behaviour can be tested without waiting for it.
+type testClock struct {
+	clock.Clock // Used for methods which the DHT does not call.
+
+	mutex   sync.Mutex
+	now     time.Time
+	waiters []*testClockWaiter
+}
+
+type testClockWaiter struct {
+	c       chan time.Time
+	at      time.Time
+	period  time.Duration // Zero for one-shot waiters.
+	stopped bool
+}
+
+type testTicker struct {
+	clock *testClock
+	w     *testClockWaiter
+}
+
+func newTestClock() *testClock {
+	return &testClock{
+		Clock: clock.Real,
+		now:   time.Now(),
+	}
+}
+
+func (c *testClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.now
+}
+
+func (c *testClock) After(d time.Duration) <-chan time.Time {
+	return c.addWaiter(d, 0).c
+}
+
+func (c *testClock) NewTicker(d time.Duration) clock.Ticker {
+	return &testTicker{clock: c, w: c.addWaiter(d, d)}
+}
+
+func (c *testClock) addWaiter(d, period time.Duration) *testClockWaiter {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	w := &testClockWaiter{
+		c:      make(chan time.Time, 1),
+		at:     c.now.Add(d),
+		period: period,
+	}
+	if d <= 0 && period == 0 {
+		w.c <- c.now
+		return w
+	}
+
+	c.waiters = append(c.waiters, w)
+	return w
+}
+
+// Move the clock forward, firing any timers and tickers which fall due. As
+// with real tickers, ticks are dropped if they are not received in time.
+func (c *testClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.now = c.now.Add(d)
+
+	var waiters []*testClockWaiter
+	for _, w := range c.waiters {
+		if w.stopped {
+			continue
+		}
+
+		if w.at.After(c.now) {
+			waiters = append(waiters, w)
+			continue
+		}
+
+		select {
+		case w.c <- c.now:
+		default:
+		}
+
+		if w.period > 0 {
+			for !w.at.After(c.now) {
+				w.at = w.at.Add(w.period)
+			}
+			waiters = append(waiters, w)
+		}
+	}
+
+	c.waiters = waiters
+}
+
+func (t *testTicker) C() <-chan time.Time {
+	return t.w.c
+}
+
+func (t *testTicker) Stop() {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+
+	t.w.stopped = true
+}
+
 func TestDHT(t *testing.T) {
 	inet := mocknet.NewInternet(nil)
 
@@ -71,14 +243,14 @@ func TestDHT(t *testing.T) {
 
 	// Announce the infohash at the last DHT.
 	var ih1 = MustParseInfoHash("e2231dfe1d791ebfe619ec7f87ae1ca103b84239")
-	announcer, err := NewSearch(dhts[len(dhts)-1], ih1, true)
+	announcer, err := NewSearch(dhts[len(dhts)-1], ih1, true, ImpliedPort)
 	if err != nil {
 		t.Fatal()
 	}
 	defer announcer.Stop()
 
 	// Try and find it at the first.
-	searcher, err := NewSearch(dhts[0], ih1, false)
+	searcher, err := NewSearch(dhts[0], ih1, false, ImpliedPort)
 	if err != nil {
 		t.Fatal()
 	}
@@ -91,3 +263,1660 @@ func TestDHT(t *testing.T) {
 		t.Fatalf("no result after 10s")
 	}
 }
+
+func TestSearchStop(t *testing.T) {
+	inet := mocknet.NewInternet(nil)
+
+	dhts, _, err := makeDHTs(inet, 1)
+	if err != nil {
+		t.Fatal()
+	}
+	defer stopDHTs(dhts)
+
+	// Stopping a search as it starts should leave the infohash forgotten, and
+	// the search should not be repeated afterwards.
+	d := dhts[0]
+	ih := MustParseInfoHash("e2231dfe1d791ebfe619ec7f87ae1ca103b84239")
+	s, err := NewSearch(d, ih, true, 6881)
+	if err != nil {
+		t.Fatal()
+	}
+	s.Stop()
+	s.Stop()
+
+	waitFor(t, "infohash to be forgotten", func() bool {
+		return len(d.ListAnnounces()) == 0
+	})
+
+	time.Sleep(100 * time.Millisecond)
+	if info := d.ListAnnounces(); len(info) != 0 {
+		t.Fatalf("unexpected info: %+v", info)
+	}
+}
+
+func TestSearchStopShared(t *testing.T) {
+	inet := mocknet.NewInternet(nil)
+
+	dhts, _, err := makeDHTs(inet, 1)
+	if err != nil {
+		t.Fatal()
+	}
+	defer stopDHTs(dhts)
+
+	d := dhts[0]
+	ih1 := MustParseInfoHash("e2231dfe1d791ebfe619ec7f87ae1ca103b84239")
+	ih2 := MustParseInfoHash("d2474e86c95b19b8bcfdb92bc12c9d44667cfa36")
+
+	err = d.RequestPeers(ih1, true, 6881)
+	if err != nil {
+		t.Fatal()
+	}
+
+	var searches []Search
+	for _, ih := range []InfoHash{ih1, ih2, ih2} {
+		s, err := NewSearch(d, ih, ih == ih2, 6881)
+		if err != nil {
+			t.Fatal()
+		}
+		defer s.Stop()
+		searches = append(searches, s)
+	}
+
+	waitFor(t, "announcements to start", func() bool {
+		return len(d.ListAnnounces()) == 2
+	})
+
+	// Stopping a search leaves the infohash announced while a client request
+	// or another search still holds it.
+	searches[0].Stop()
+	searches[1].Stop()
+	time.Sleep(100 * time.Millisecond)
+	if info := d.ListAnnounces(); len(info) != 2 {
+		t.Fatalf("unexpected info: %+v", info)
+	}
+
+	searches[2].Stop()
+	d.StopAnnouncing(ih1)
+	waitFor(t, "announcements to stop", func() bool {
+		return len(d.ListAnnounces()) == 0
+	})
+}
+
+func TestDatum(t *testing.T) {
+	inet := mocknet.NewInternet(nil)
+
+	dhts, _ := makeChain(t, inet, 10)
+	defer stopDHTs(dhts)
+
+	publisher := dhts[len(dhts)-1]
+	datum := &Datum{Value: []byte("12:Hello World!")}
+	err := publisher.PutDatum(datum)
+	if err != nil {
+		t.Fatal()
+	}
+
+	waitFor(t, "datum to be stored", func() bool {
+		info := publisher.ListPublishedData()
+		return len(info) == 1 && info[0].NumStored > 0
+	})
+
+	err = dhts[0].RequestDatum(datum.target())
+	if err != nil {
+		t.Fatal()
+	}
+
+	select {
+	case r := <-dhts[0].DatumChan():
+		if r.Target != datum.target() || r.Datum == nil || !bytes.Equal(r.Datum.Value, datum.Value) {
+			t.Fatalf("unexpected result: %#v", r)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("no result after 10s")
+	}
+}
+
+// Sends a query from a raw KRPC socket and waits for the matching response.
+// Queries sent to the socket by the DHT are ignored.
+func rawQuery(t *testing.T, conn denet.UDPConn, addr *net.UDPAddr, method string, args interface{}) *krpc.Message {
+	q, err := krpc.MakeQuery(method, args)
+	if err != nil {
+		t.Fatalf("cannot make query: %v", err)
+	}
+
+	err = krpc.Write(conn, *addr, q)
+	if err != nil {
+		t.Fatalf("cannot write query: %v", err)
+	}
+
+	msgChan := make(chan *krpc.Message, 1)
+	go func() {
+		for {
+			msg, _, err := krpc.Read(conn)
+			if err != nil {
+				close(msgChan)
+				return
+			}
+
+			if msg.TxID == q.TxID {
+				msgChan <- msg
+				return
+			}
+		}
+	}()
+
+	select {
+	case msg := <-msgChan:
+		if msg == nil {
+			t.Fatalf("cannot read response")
+		}
+
+		err = msg.ResponseAsMethod(method)
+		if err != nil {
+			t.Fatalf("cannot decode response: %v", err)
+		}
+
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no response after 5s")
+		return nil
+	}
+}
+
+func TestDatumStorage(t *testing.T) {
+	inet := mocknet.NewInternet(nil)
+
+	dhts, addrs, err := makeDHTs(inet, 1)
+	if err != nil {
+		t.Fatal()
+	}
+	defer stopDHTs(dhts)
+
+	dhtAddr := mustResolve(addrs[0])
+	conn, err := inet.ListenUDP("udp", mustResolve("1.2.3.100:5555"))
+	if err != nil {
+		t.Fatal()
+	}
+	defer conn.Close()
+
+	id := GenerateNodeID()
+	get := func(target InfoHash, seq *uint64) *krGetRes {
+		msg := rawQuery(t, conn, dhtAddr, "get", &krGetReq{
+			ID:     id,
+			Target: target,
+			Seq:    seq,
+		})
+		if msg.Type != "r" {
+			t.Fatalf("get failed: %v", msg)
+		}
+		if ip := net.UDPAddr(msg.IP); ip.String() != "1.2.3.100:5555" {
+			t.Fatalf("response does not carry requester address: %v", msg.IP)
+		}
+		return msg.Response.(*krGetRes)
+	}
+
+	// Values may be arbitrary bencoded values, not just strings.
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal()
+	}
+
+	dictValue := []byte("d1:ai1e1:bl1:x1:yee")
+	dictMutable, err := NewMutableDatum(privateKey, dictValue, nil, 7)
+	if err != nil {
+		t.Fatal()
+	}
+
+	data := []Datum{bep44Immutable, bep44Mutable, bep44MutableSalted, {Value: dictValue}, *dictMutable}
+	for _, d := range data {
+		target := d.target()
+		res := get(target, nil)
+		if len(res.Value) != 0 {
+			t.Fatalf("unexpected value before put")
+		}
+
+		req := &krPutReq{
+			ID:    id,
+			Token: res.Token,
+			Value: d.Value,
+		}
+		if d.IsMutable() {
+			req.Key = d.Key
+			req.Salt = d.Salt
+			req.Signature = d.Signature
+			req.SequenceNo = &d.SequenceNo
+		}
+
+		msg := rawQuery(t, conn, dhtAddr, "put", req)
+		if msg.Type != "r" {
+			t.Fatalf("put failed: %v", msg)
+		}
+
+		res = get(target, nil)
+		if !bytes.Equal(res.Value, d.Value) || res.Key != d.Key || res.Signature != d.Signature {
+			t.Fatalf("unexpected get response: %#v", res)
+		}
+
+		if !d.IsMutable() {
+			if res.SequenceNo != nil {
+				t.Fatalf("unexpected sequence number for immutable datum")
+			}
+			continue
+		}
+
+		if res.SequenceNo == nil || *res.SequenceNo != d.SequenceNo {
+			t.Fatalf("wrong sequence number")
+		}
+
+		// The value should be omitted if the requester already has it.
+		seq := d.SequenceNo
+		res = get(target, &seq)
+		if len(res.Value) != 0 || res.Signature != "" || res.SequenceNo == nil || *res.SequenceNo != d.SequenceNo {
+			t.Fatalf("unexpected get response with current seq: %#v", res)
+		}
+
+		seq = d.SequenceNo - 1
+		res = get(target, &seq)
+		if !bytes.Equal(res.Value, d.Value) || res.Signature != d.Signature {
+			t.Fatalf("unexpected get response with old seq: %#v", res)
+		}
+
+		// Putting the same value with the same sequence number refreshes it, but
+		// a different value or an older sequence number is rejected.
+		msg = rawQuery(t, conn, dhtAddr, "put", req)
+		if msg.Type != "r" {
+			t.Fatalf("refresh failed: %v", msg)
+		}
+
+		changed := *req
+		changed.Value = []byte("i42e")
+		msg = rawQuery(t, conn, dhtAddr, "put", &changed)
+		if msg.Type != "e" || msg.Error.Code != krpc.ErrorCodeSequenceNumber {
+			t.Fatalf("expected sequence number error: %v", msg)
+		}
+
+		older := *req
+		older.SequenceNo = &seq
+		msg = rawQuery(t, conn, dhtAddr, "put", &older)
+		if msg.Type != "e" || msg.Error.Code != krpc.ErrorCodeSequenceNumber {
+			t.Fatalf("expected sequence number error: %v", msg)
+		}
+	}
+}
+
+func TestDatumRepublish(t *testing.T) {
+	inet := mocknet.NewInternet(nil)
+	clk := newTestClock()
+
+	dhts, _ := makeChainWithConfig(t, inet, 3, Config{
+		RepublishPeriod: 1 * time.Minute,
+		DatumLifetime:   2 * time.Minute,
+		Clock:           clk,
+	})
+	defer stopDHTs(dhts)
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal()
+	}
+
+	// A mutable datum cannot have its sequence number increased when it is put
+	// again, so the storing nodes must accept a repeated put.
+	mutable, err := NewMutableDatum(privateKey, []byte("12:Hello World!"), nil, 1)
+	if err != nil {
+		t.Fatal()
+	}
+
+	publisher, getter := dhts[len(dhts)-1], dhts[0]
+	for _, datum := range []*Datum{{Value: []byte("12:Hello World!")}, mutable} {
+		err = publisher.PutDatum(datum)
+		if err != nil {
+			t.Fatal()
+		}
+
+		waitFor(t, "datum to be stored", func() bool {
+			info := publisher.ListPublishedData()
+			return len(info) == 1 && info[0].Target == datum.target() && info[0].NumStored > 0
+		})
+
+		// The datum is put again once the republish period has elapsed.
+		clk.Advance(1 * time.Minute)
+		republished := clk.Now()
+		waitFor(t, "datum to be republished", func() bool {
+			info := publisher.ListPublishedData()
+			return len(info) == 1 && info[0].NumStored > 0 && !info[0].LastStored.Before(republished)
+		})
+
+		info := publisher.ListPublishedData()
+		if info[0].LastError != nil {
+			t.Fatalf("datum rejected: %v", info[0].LastError)
+		}
+
+		publisher.UnpublishDatum(datum.target())
+		if len(publisher.ListPublishedData()) != 0 {
+			t.Fatalf("datum still published after UnpublishDatum")
+		}
+
+		// Having been put again, the datum outlives its original lifetime on the
+		// storing nodes.
+		clk.Advance(90 * time.Second)
+		err = getter.RequestDatum(datum.target())
+		if err != nil {
+			t.Fatal()
+		}
+
+		select {
+		case r := <-getter.DatumChan():
+			if r.Datum == nil || !bytes.Equal(r.Datum.Value, datum.Value) {
+				t.Fatalf("datum expired: %#v", r)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("no result after 10s")
+		}
+	}
+}
+
+func TestDatumWatch(t *testing.T) {
+	inet := mocknet.NewInternet(nil)
+	clk := newTestClock()
+
+	dhts, _ := makeChainWithConfig(t, inet, 3, Config{Clock: clk})
+	defer stopDHTs(dhts)
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publisher, watcher := dhts[len(dhts)-1], dhts[0]
+
+	cfg := &WatchConfig{
+		MinInterval: 1 * time.Minute,
+		MaxInterval: 2 * time.Minute,
+	}
+	w, err := watcher.WatchDatum(publicKey, []byte("salt"), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	for seq := uint64(1); seq <= 2; seq++ {
+		datum, err := NewMutableDatum(privateKey, []byte(fmt.Sprintf("i%de", seq)), []byte("salt"), seq)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = publisher.PutDatum(datum)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The new version is seen once the watch next polls.
+		advanceUntil(t, clk, cfg.MinInterval, 10*cfg.MaxInterval, func() bool {
+			select {
+			case d := <-w.Chan():
+				if d.SequenceNo > seq {
+					t.Fatalf("unexpected sequence number: %d", d.SequenceNo)
+				}
+				if d.SequenceNo == seq && !bytes.Equal(d.Value, datum.Value) {
+					t.Fatalf("unexpected value: %q", d.Value)
+				}
+				return d.SequenceNo == seq
+			case <-time.After(10 * time.Millisecond):
+				return false
+			}
+		})
+	}
+
+	w.Stop()
+	for range w.Chan() {
+	}
+}
+
+func TestDatumQuota(t *testing.T) {
+	inet := mocknet.NewInternet(nil)
+
+	dhts, addrs, err := makeDHTsWithConfig(inet, 1, Config{
+		MaxDatumsPerIP: 1,
+	})
+	if err != nil {
+		t.Fatal()
+	}
+	defer stopDHTs(dhts)
+
+	dhtAddr := mustResolve(addrs[0])
+	conn, err := inet.ListenUDP("udp", mustResolve("1.2.3.100:5555"))
+	if err != nil {
+		t.Fatal()
+	}
+	defer conn.Close()
+
+	id := GenerateNodeID()
+	put := func(value string) *krpc.Message {
+		d := &Datum{Value: []byte(value)}
+		msg := rawQuery(t, conn, dhtAddr, "get", &krGetReq{
+			ID:     id,
+			Target: d.target(),
+		})
+		if msg.Type != "r" {
+			t.Fatalf("get failed: %v", msg)
+		}
+
+		return rawQuery(t, conn, dhtAddr, "put", &krPutReq{
+			ID:    id,
+			Token: msg.Response.(*krGetRes).Token,
+			Value: d.Value,
+		})
+	}
+
+	if msg := put("1:a"); msg.Type != "r" {
+		t.Fatalf("put failed: %v", msg)
+	}
+
+	// Putting the same datum again only refreshes it.
+	if msg := put("1:a"); msg.Type != "r" {
+		t.Fatalf("refresh failed: %v", msg)
+	}
+
+	msg := put("1:b")
+	if msg.Type != "e" || msg.Error.Code != krpc.ErrorCodeServer {
+		t.Fatalf("expected quota error: %v", msg)
+	}
+}
+
+func TestNodeIDPolicyEnforce(t *testing.T) {
+	inet := mocknet.NewInternet(nil)
+
+	dhts, addrs, err := makeDHTsWithConfig(inet, 1, Config{
+		NodeIDPolicy: NodeIDPolicyEnforce,
+	})
+	if err != nil {
+		t.Fatal()
+	}
+	defer stopDHTs(dhts)
+
+	dhtAddr := mustResolve(addrs[0])
+
+	secureAddr, insecureAddr := mustResolve("1.2.3.100:5555"), mustResolve("1.2.3.101:5555")
+	secureID := conformNodeID(secureAddr.IP, GenerateNodeID())
+	insecureID := GenerateNodeID()
+	for nodeIDIsAllowed(insecureAddr.IP, insecureID) {
+		insecureID = GenerateNodeID()
+	}
+
+	secureConn, err := inet.ListenUDP("udp", secureAddr)
+	if err != nil {
+		t.Fatal()
+	}
+	defer secureConn.Close()
+
+	insecureConn, err := inet.ListenUDP("udp", insecureAddr)
+	if err != nil {
+		t.Fatal()
+	}
+	defer insecureConn.Close()
+
+	rawQuery(t, secureConn, dhtAddr, "ping", &krPing{ID: secureID})
+	rawQuery(t, insecureConn, dhtAddr, "ping", &krPing{ID: insecureID})
+
+	msg := rawQuery(t, secureConn, dhtAddr, "find_node", &krFindNodeReq{
+		ID:     secureID,
+		Target: insecureID,
+	})
+	if msg.Type != "r" {
+		t.Fatalf("find_node failed: %v", msg)
+	}
+
+	foundSecure := false
+	for _, nl := range msg.Response.(*krFindNodeRes).Nodes {
+		if nl.NodeID == insecureID {
+			t.Fatalf("node with insecure ID returned")
+		}
+		foundSecure = foundSecure || nl.NodeID == secureID
+	}
+
+	if !foundSecure {
+		t.Fatalf("node with secure ID not returned")
+	}
+
+	// Nodes which answer pings. One reveals an insecure ID only in its
+	// response.
+	answerPings := func(a string, id NodeID) (*net.UDPAddr, <-chan struct{}) {
+		addr := mustResolve(a)
+		conn, err := inet.ListenUDP("udp", addr)
+		if err != nil {
+			t.Fatal()
+		}
+
+		answered := make(chan struct{}, 1)
+		go func() {
+			defer conn.Close()
+			for {
+				msg, raddr, err := krpc.Read(conn)
+				if err != nil {
+					return
+				}
+
+				if msg.Method == "ping" {
+					krpc.WriteResponse(conn, *raddr, msg, &krPing{ID: id})
+					select {
+					case answered <- struct{}{}:
+					default:
+					}
+				}
+			}
+		}()
+		return addr, answered
+	}
+
+	d := dhts[0]
+	insecureAddr2, answered := answerPings("1.2.3.102:5555", insecureID)
+	d.AddNode(NodeLocator{Addr: *insecureAddr2})
+	d.AddNode(NodeLocator{NodeID: insecureID, Addr: *insecureAddr})
+	select {
+	case <-answered:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("node not pinged")
+	}
+
+	// Responses are processed in order, so by the time this node is reachable
+	// the other's response has been dealt with.
+	secureID2 := conformNodeID(mustResolve("1.2.3.103:5555").IP, GenerateNodeID())
+	secureAddr2, _ := answerPings("1.2.3.103:5555", secureID2)
+	d.AddNode(NodeLocator{Addr: *secureAddr2})
+	waitFor(t, "node to be reachable", func() bool {
+		return len(d.ListReachableNodes()) > 0
+	})
+
+	if nodes := d.ListReachableNodes(); len(nodes) != 1 || nodes[0].NodeID != secureID2 {
+		t.Fatalf("unexpected reachable nodes: %v", nodes)
+	}
+
+	// Stop the node so that its routing table can be examined safely. Only
+	// the nodes with secure IDs are known.
+	stopDHTs(dhts)
+	rt := d.neighbourhood.routingTable
+	if rt.Size() != 2 || rt.FindByAddress(*secureAddr) == nil || rt.FindByAddress(*secureAddr2) == nil {
+		t.Fatalf("unexpected node count %d", rt.Size())
+	}
+}
+
+func TestExternalIP(t *testing.T) {
+	inet := mocknet.NewInternet(nil)
+
+	dhts, _, err := makeDHTs(inet, 1)
+	if err != nil {
+		t.Fatal()
+	}
+	defer stopDHTs(dhts)
+
+	d := dhts[0]
+	oldNodeID := d.NodeID()
+	externalAddr := krpc.Endpoint(*mustResolve("5.6.7.8:5555"))
+
+	// Have several nodes answer our pings, reporting the same external address.
+	for i := 0; i < externalIPMinVotes; i++ {
+		addr := mustResolve(fmt.Sprintf("1.2.4.%d:5555", i+1))
+		conn, err := inet.ListenUDP("udp", addr)
+		if err != nil {
+			t.Fatal()
+		}
+		defer conn.Close()
+
+		go func() {
+			id := GenerateNodeID()
+			for {
+				msg, raddr, err := krpc.Read(conn)
+				if err != nil {
+					return
+				}
+
+				if msg.Type != "q" || msg.Method != "ping" {
+					continue
+				}
+
+				res, _ := bencode.EncodeBytes(&krPing{ID: id})
+				krpc.Write(conn, *raddr, &krpc.Message{
+					TxID:      msg.TxID,
+					Type:      "r",
+					Response_: res,
+					IP:        externalAddr,
+				})
+			}
+		}()
+
+		d.AddNode(NodeLocator{Addr: *addr})
+	}
+
+	waitFor(t, "external IP to be determined", func() bool {
+		return externalAddr.IP.Equal(d.ExternalIP())
+	})
+
+	// The generated node ID should have been changed to conform to the
+	// external IP.
+	nodeID := d.NodeID()
+	if nodeID == oldNodeID || !nodeIDIsAllowed(externalAddr.IP, nodeID) {
+		t.Fatalf("node ID not conformed to external IP")
+	}
+}
+
+func TestQueryTimeout(t *testing.T) {
+	// Queries should time out at the deadline whether or not they are
+	// retransmitted.
+	testQueryTimeout(t, 0)
+	testQueryTimeout(t, -1)
+}
+
+func testQueryTimeout(t *testing.T, maxRetransmits int) {
+	inet := mocknet.NewInternet(nil)
+	clk := newTestClock()
+
+	dhts, _, err := makeDHTsWithConfig(inet, 1, Config{
+		QueryTimeout:   3 * time.Second,
+		MaxRetransmits: maxRetransmits,
+		Clock:          clk,
+	})
+	if err != nil {
+		t.Fatal()
+	}
+	defer stopDHTs(dhts)
+
+	// A node which never responds.
+	addr := mustResolve("1.2.4.1:5555")
+	conn, err := inet.ListenUDP("udp", addr)
+	if err != nil {
+		t.Fatal()
+	}
+	defer conn.Close()
+
+	d := dhts[0]
+	d.AddNode(NodeLocator{
+		NodeID: GenerateNodeID(),
+		Addr:   *addr,
+	})
+
+	// Wait for the node to be pinged, so that it is known.
+	_, _, err = krpc.Read(conn)
+	if err != nil {
+		t.Fatal()
+	}
+
+	// The search should conclude once the get query times out, well before the
+	// search deadline.
+	target := ImmutableTarget([]byte("12:Hello World!"))
+	err = d.RequestDatum(target)
+	if err != nil {
+		t.Fatal()
+	}
+
+	var res DatumResult
+	elapsed := advanceUntil(t, clk, minRTO/2, datumSearchDuration/2, func() bool {
+		select {
+		case res = <-d.DatumChan():
+			return true
+		case <-time.After(5 * time.Millisecond):
+			return false
+		}
+	})
+
+	if res.Target != target || res.Datum != nil {
+		t.Fatalf("unexpected result: %v", res)
+	}
+	if elapsed < 3*time.Second {
+		t.Fatalf("query timed out after %v", elapsed)
+	}
+}
+
+func TestQueryTimeoutRTT(t *testing.T) {
+	inet := mocknet.NewInternet(nil)
+	clk := newTestClock()
+
+	dhts, _, err := makeDHTsWithConfig(inet, 1, Config{
+		QueryTimeout: 1 * time.Minute,
+		Clock:        clk,
+	})
+	if err != nil {
+		t.Fatal()
+	}
+	defer stopDHTs(dhts)
+
+	// A node which answers only the first ping, after 100ms.
+	addr := mustResolve("1.2.4.1:5555")
+	conn, err := inet.ListenUDP("udp", addr)
+	if err != nil {
+		t.Fatal()
+	}
+	defer conn.Close()
+
+	d := dhts[0]
+	id := GenerateNodeID()
+	d.AddNode(NodeLocator{NodeID: id, Addr: *addr})
+
+	msg, raddr, err := krpc.Read(conn)
+	if err != nil {
+		t.Fatal()
+	}
+	clk.Advance(100 * time.Millisecond)
+	krpc.WriteResponse(conn, *raddr, msg, &krPing{ID: id})
+
+	waitFor(t, "RTT to be measured", func() bool {
+		nodes := d.ListReachableNodes()
+		return len(nodes) == 1 && nodes[0].RTT == 100*time.Millisecond
+	})
+
+	// With an RTO of 300ms, the query and its two retransmissions time out
+	// after 2.1s rather than QueryTimeout.
+	target := ImmutableTarget([]byte("12:Hello World!"))
+	err = d.RequestDatum(target)
+	if err != nil {
+		t.Fatal()
+	}
+
+	elapsed := advanceUntil(t, clk, minRTO/2, datumSearchDuration/2, func() bool {
+		select {
+		case <-d.DatumChan():
+			return true
+		case <-time.After(5 * time.Millisecond):
+			return false
+		}
+	})
+
+	if elapsed < 2100*time.Millisecond || elapsed > 2500*time.Millisecond {
+		t.Fatalf("query timed out after %v", elapsed)
+	}
+}
+
+func TestRetransmit(t *testing.T) {
+	inet := mocknet.NewInternet(nil)
+	clk := newTestClock()
+
+	dhts, _, err := makeDHTsWithConfig(inet, 1, Config{Clock: clk})
+	if err != nil {
+		t.Fatal()
+	}
+	defer stopDHTs(dhts)
+
+	// A node on a lossy link, which only sees each query the second time it is
+	// sent.
+	addr := mustResolve("1.2.4.1:5555")
+	conn, err := inet.ListenUDP("udp", addr)
+	if err != nil {
+		t.Fatal()
+	}
+	defer conn.Close()
+
+	go func() {
+		id := GenerateNodeID()
+		seen := map[string]struct{}{}
+		for {
+			msg, raddr, err := krpc.Read(conn)
+			if err != nil {
+				return
+			}
+
+			if msg.Type != "q" || msg.Method != "ping" {
+				continue
+			}
+
+			if _, ok := seen[msg.TxID]; !ok {
+				seen[msg.TxID] = struct{}{}
+				continue
+			}
+
+			krpc.WriteResponse(conn, *raddr, msg, &krPing{ID: id})
+		}
+	}()
+
+	d := dhts[0]
+	d.AddNode(NodeLocator{Addr: *addr})
+
+	advanceUntil(t, clk, minRTO/2, 3*initialRTO, func() bool {
+		nodes := d.ListReachableNodes()
+		return len(nodes) == 1 && nodes[0].Addr.String() == addr.String()
+	})
+}
+
+func TestQueryError(t *testing.T) {
+	inet := mocknet.NewInternet(nil)
+
+	dhts, _, err := makeDHTs(inet, 1)
+	if err != nil {
+		t.Fatal()
+	}
+	defer stopDHTs(dhts)
+
+	// A node which rejects all puts.
+	addr := mustResolve("1.2.4.1:5555")
+	conn, err := inet.ListenUDP("udp", addr)
+	if err != nil {
+		t.Fatal()
+	}
+	defer conn.Close()
+
+	id := GenerateNodeID()
+	go func() {
+		for {
+			msg, raddr, err := krpc.Read(conn)
+			if err != nil {
+				return
+			}
+
+			switch msg.Method {
+			case "ping":
+				krpc.WriteResponse(conn, *raddr, msg, &krPing{ID: id})
+			case "get":
+				krpc.WriteResponse(conn, *raddr, msg, &krGetRes{ID: id, Token: []byte("token")})
+			case "put":
+				krpc.WriteError(conn, *raddr, msg, krpc.NewError(krpc.ErrorCodeSequenceNumber, ""))
+			}
+		}
+	}()
+
+	d := dhts[0]
+	d.AddNode(NodeLocator{NodeID: id, Addr: *addr})
+	waitFor(t, "node to be reachable", func() bool {
+		return len(d.ListReachableNodes()) == 1
+	})
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal()
+	}
+
+	datum, err := NewMutableDatum(privateKey, []byte("i1e"), nil, 1)
+	if err != nil {
+		t.Fatal()
+	}
+
+	err = d.PutDatum(datum)
+	if err != nil {
+		t.Fatal()
+	}
+
+	select {
+	case qe := <-d.QueryErrorChan():
+		if qe.Method != "put" || qe.Target != datum.target() || qe.Node.NodeID != id || qe.Err.Code != krpc.ErrorCodeSequenceNumber {
+			t.Fatalf("unexpected query error: %#v", qe)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no query error reported")
+	}
+
+	info := d.ListPublishedData()
+	if len(info) != 1 || info[0].NumStored != 0 {
+		t.Fatalf("unexpected published data: %v", info)
+	}
+	if kerr, ok := info[0].LastError.(*krpc.Error); !ok || kerr.Code != krpc.ErrorCodeSequenceNumber {
+		t.Fatalf("unexpected last error: %v", info[0].LastError)
+	}
+}
+
+func TestQueryErrorReplies(t *testing.T) {
+	inet := mocknet.NewInternet(nil)
+
+	dhts, addrs, err := makeDHTs(inet, 1)
+	if err != nil {
+		t.Fatal()
+	}
+	defer stopDHTs(dhts)
+
+	dhtAddr := mustResolve(addrs[0])
+	conn, err := inet.ListenUDP("udp", mustResolve("1.2.3.100:5555"))
+	if err != nil {
+		t.Fatal()
+	}
+	defer conn.Close()
+
+	id := GenerateNodeID()
+	tests := []struct {
+		Method string
+		Args   interface{}
+		Code   krpc.ErrorCode
+	}{
+		{"frobnicate", &krPing{ID: id}, krpc.ErrorCodeMethodUnknown},
+		{"get_peers", &krPing{ID: id}, krpc.ErrorCodeProtocol},
+		{"find_node", &krFindNodeReq{ID: id}, krpc.ErrorCodeProtocol},
+		{"ping", map[string]interface{}{}, krpc.ErrorCodeProtocol},
+		{"get", map[string]interface{}{"id": 42, "target": 42}, krpc.ErrorCodeProtocol},
+	}
+
+	for _, tst := range tests {
+		msg := rawQuery(t, conn, dhtAddr, tst.Method, tst.Args)
+		if msg.Type != "e" || msg.Error.Code != tst.Code {
+			t.Fatalf("%s: expected error %d: %v", tst.Method, tst.Code, msg)
+		}
+	}
+
+	// Valid queries are still answered.
+	msg := rawQuery(t, conn, dhtAddr, "ping", &krPing{ID: id})
+	if msg.Type != "r" {
+		t.Fatalf("ping failed: %v", msg)
+	}
+}
+
+func TestMalformedResponse(t *testing.T) {
+	inet := mocknet.NewInternet(nil)
+
+	// The clock never advances, so no query times out.
+	dhts, _, err := makeDHTsWithConfig(inet, 1, Config{Clock: newTestClock()})
+	if err != nil {
+		t.Fatal()
+	}
+	defer stopDHTs(dhts)
+
+	// A node which answers pings but sends malformed get_peers responses.
+	addr := mustResolve("1.2.4.1:5555")
+	conn, err := inet.ListenUDP("udp", addr)
+	if err != nil {
+		t.Fatal()
+	}
+	defer conn.Close()
+
+	id := GenerateNodeID()
+	go func() {
+		for {
+			msg, raddr, err := krpc.Read(conn)
+			if err != nil {
+				return
+			}
+
+			switch msg.Method {
+			case "ping":
+				krpc.WriteResponse(conn, *raddr, msg, &krPing{ID: id})
+			case "get_peers":
+				krpc.WriteResponse(conn, *raddr, msg, map[string]interface{}{"id": 42})
+			}
+		}
+	}()
+
+	d := dhts[0]
+	d.AddNode(NodeLocator{NodeID: id, Addr: *addr})
+	waitFor(t, "node to be reachable", func() bool {
+		return len(d.ListReachableNodes()) == 1
+	})
+
+	// The failed query lets the lookup finish.
+	peers, err := d.GetPeers(context.Background(), MustParseInfoHash("e2231dfe1d791ebfe619ec7f87ae1ca103b84239"), nil)
+	if err != nil {
+		t.Fatal()
+	}
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-peers:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("lookup did not finish")
+		}
+	}
+}
+
+func TestLookupResult(t *testing.T) {
+	testLookupResult(t, RoutingTableTrie)
+	testLookupResult(t, RoutingTableKBuckets)
+}
+
+func testLookupResult(t *testing.T, kind RoutingTableKind) {
+	inet := mocknet.NewInternet(nil)
+
+	dhts, addrs := makeChainWithConfig(t, inet, 10, Config{RoutingTable: kind})
+	defer stopDHTs(dhts)
+
+	// A newcomer which knows of only one node must look up the others through
+	// it.
+	d, err := createDHT(inet, &Config{Address: "1.2.3.11:5555", RoutingTable: kind})
+	if err != nil {
+		t.Fatal()
+	}
+	defer d.Stop()
+
+	d.AddNode(NodeLocator{
+		NodeID: dhts[0].NodeID(),
+		Addr:   *mustResolve(addrs[0]),
+	})
+
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case res := <-d.LookupChan():
+			if res.Method != "find_node" || res.Target != InfoHash(dhts[0].NodeID()) {
+				continue
+			}
+
+			if res.NumResponded < kNodes || res.NumQueried < res.NumResponded || res.Hops < 2 {
+				t.Fatalf("unexpected result: %+v", res)
+			}
+			return
+		case <-timeout:
+			t.Fatalf("lookup did not finish")
+		}
+	}
+}
+
+func TestAnnounce(t *testing.T) {
+	inet := mocknet.NewInternet(nil)
+
+	dhts, _ := makeChain(t, inet, 10)
+	defer stopDHTs(dhts)
+
+	d := dhts[0]
+	ih := MustParseInfoHash("e2231dfe1d791ebfe619ec7f87ae1ca103b84239")
+	err := d.RequestPeers(ih, true, ImpliedPort)
+	if err != nil {
+		t.Fatal()
+	}
+
+	// Only the kNodes closest of the other nodes should be announced to.
+	select {
+	case res := <-d.AnnounceChan():
+		if res.InfoHash != ih || res.NumQueried != kNodes || res.NumAccepted != kNodes {
+			t.Fatalf("unexpected result: %+v", res)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("announce did not finish")
+	}
+
+	// Stop the nodes so that their peer stores can be examined safely.
+	stopDHTs(dhts)
+
+	numStored := 0
+	for _, o := range dhts[1:] {
+		if len(o.peersFor(ih)) > 0 {
+			numStored++
+		}
+	}
+	if numStored != kNodes {
+		t.Fatalf("announce stored at %d nodes", numStored)
+	}
+}
+
+func TestAnnouncePort(t *testing.T) {
+	inet := mocknet.NewInternet(nil)
+
+	dhts, _ := makeChain(t, inet, 10)
+	defer stopDHTs(dhts)
+
+	// Nodes interested in the infohash report announcements they receive.
+	ih := MustParseInfoHash("e2231dfe1d791ebfe619ec7f87ae1ca103b84239")
+	for _, d := range dhts[1:] {
+		d.RequestPeers(ih, false, ImpliedPort)
+	}
+
+	err := dhts[0].RequestPeers(ih, true, 6881)
+	if err != nil {
+		t.Fatal()
+	}
+
+	select {
+	case res := <-dhts[0].AnnounceChan():
+		if res.NumAccepted == 0 {
+			t.Fatalf("unexpected result: %+v", res)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("announce did not finish")
+	}
+
+	want := "1.2.3.1:6881"
+	numReported := 0
+	for _, d := range dhts[1:] {
+		// Results are delivered asynchronously.
+	loop:
+		for {
+			select {
+			case p := <-d.PeersChan():
+				if p.Addr.String() != want {
+					t.Fatalf("reported %v", &p.Addr)
+				}
+				numReported++
+			case <-time.After(50 * time.Millisecond):
+				break loop
+			}
+		}
+	}
+
+	if numReported == 0 {
+		t.Fatalf("announce not reported")
+	}
+
+	// Stop the nodes so that their peer stores can be examined safely.
+	stopDHTs(dhts)
+
+	for _, d := range dhts[1:] {
+		for _, addr := range d.peersFor(ih) {
+			if addr.String() != want {
+				t.Fatalf("stored %v", &addr)
+			}
+		}
+	}
+}
+
+func TestReannounce(t *testing.T) {
+	inet := mocknet.NewInternet(nil)
+	clk := newTestClock()
+
+	dhts, _ := makeChainWithConfig(t, inet, 10, Config{
+		ReannouncePeriod: 1 * time.Minute,
+		Clock:            clk,
+
+		// Queries in flight when the clock is advanced should not time out.
+		QueryTimeout: 2 * time.Minute,
+	})
+	defer stopDHTs(dhts)
+
+	d := dhts[0]
+	ih := MustParseInfoHash("e2231dfe1d791ebfe619ec7f87ae1ca103b84239")
+	err := d.RequestPeers(ih, true, 6881)
+	if err != nil {
+		t.Fatal()
+	}
+
+	// The infohash should be announced once immediately and then again
+	// periodically without further requests.
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			info := d.ListAnnounces()
+			if len(info) != 1 {
+				t.Fatalf("unexpected info: %+v", info)
+			}
+
+			wait := info[0].NextAnnounce.Sub(clk.Now())
+			if wait < 54*time.Second || wait > 66*time.Second {
+				t.Fatalf("next announcement in %v", wait)
+			}
+			clk.Advance(wait)
+		}
+
+		select {
+		case res := <-d.AnnounceChan():
+			if res.InfoHash != ih || res.NumAccepted == 0 {
+				t.Fatalf("unexpected result: %+v", res)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("only %d announcements", i)
+		}
+	}
+
+	info := d.ListAnnounces()
+	if len(info) != 1 || info[0].InfoHash != ih || info[0].Port != 6881 ||
+		info[0].NumAccepted == 0 || !info[0].LastAnnounced.Equal(clk.Now()) ||
+		info[0].NextAnnounce.IsZero() {
+		t.Fatalf("unexpected info: %+v", info)
+	}
+}
+
+func TestForget(t *testing.T) {
+	inet := mocknet.NewInternet(nil)
+
+	dhts, _ := makeChain(t, inet, 5)
+	defer stopDHTs(dhts)
+
+	ih := MustParseInfoHash("e2231dfe1d791ebfe619ec7f87ae1ca103b84239")
+	d := dhts[0]
+	d.RequestPeers(ih, true, 6881)
+	<-d.AnnounceChan()
+
+	// Stopping announcing leaves the interest in place.
+	d.StopAnnouncing(ih)
+	dhts[1].RequestPeers(ih, true, 6882)
+	<-dhts[1].AnnounceChan()
+
+	select {
+	case p := <-d.PeersChan():
+		if p.Addr.Port != 6882 {
+			t.Fatalf("unexpected peer %v", &p.Addr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("announcement not reported")
+	}
+
+	if len(d.ListAnnounces()) != 0 {
+		t.Fatalf("still announcing")
+	}
+
+	// Once forgotten, announcements are no longer reported.
+	d.Forget(ih)
+	dhts[2].RequestPeers(ih, true, 6883)
+	<-dhts[2].AnnounceChan()
+
+	select {
+	case p := <-d.PeersChan():
+		t.Fatalf("unexpected peer %v", &p.Addr)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestGetPeers(t *testing.T) {
+	inet := mocknet.NewInternet(nil)
+
+	dhts, addrs := makeChain(t, inet, 10)
+	defer stopDHTs(dhts)
+
+	ih := MustParseInfoHash("e2231dfe1d791ebfe619ec7f87ae1ca103b84239")
+	announcer := dhts[len(dhts)-1]
+	announcer.RequestPeers(ih, true, 6881)
+	<-announcer.AnnounceChan()
+
+	d := dhts[0]
+	ch, err := d.GetPeers(context.Background(), ih, nil)
+	if err != nil {
+		t.Fatal()
+	}
+
+	wantAddr := *mustResolve(addrs[len(addrs)-1])
+	wantAddr.Port = 6881
+	want := wantAddr.String()
+	found := false
+	timeout := time.After(10 * time.Second)
+loop:
+	for {
+		select {
+		case p, ok := <-ch:
+			if !ok {
+				break loop
+			}
+			if p.InfoHash != ih {
+				t.Fatalf("unexpected result: %v", p)
+			}
+			found = found || p.Addr.String() == want
+		case <-timeout:
+			t.Fatalf("stream not closed")
+		}
+	}
+
+	if !found {
+		t.Fatalf("peer not found")
+	}
+
+	// The results are not duplicated on the global channel.
+	select {
+	case p := <-d.PeersChan():
+		t.Fatalf("unexpected result on PeersChan: %v", p)
+	default:
+	}
+}
+
+func TestGetPeersCancel(t *testing.T) {
+	inet := mocknet.NewInternet(nil)
+
+	// The clock is not advanced, so that queries never time out.
+	dhts, _, err := makeDHTsWithConfig(inet, 1, Config{Clock: newTestClock()})
+	if err != nil {
+		t.Fatal()
+	}
+	defer stopDHTs(dhts)
+
+	// A node which never responds, so that the lookup does not finish by
+	// itself.
+	addr := mustResolve("1.2.4.1:5555")
+	conn, err := inet.ListenUDP("udp", addr)
+	if err != nil {
+		t.Fatal()
+	}
+	defer conn.Close()
+
+	d := dhts[0]
+	d.AddNode(NodeLocator{NodeID: GenerateNodeID(), Addr: *addr})
+
+	// Wait for the node to be pinged, so that it is known.
+	_, _, err = krpc.Read(conn)
+	if err != nil {
+		t.Fatal()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := d.GetPeers(ctx, MustParseInfoHash("e2231dfe1d791ebfe619ec7f87ae1ca103b84239"), nil)
+	if err != nil {
+		t.Fatal()
+	}
+
+	// Wait for the get_peers query, after which the lookup can only end by
+	// cancellation.
+	for {
+		msg, _, err := krpc.Read(conn)
+		if err != nil {
+			t.Fatal()
+		}
+		if msg.Method == "get_peers" {
+			break
+		}
+	}
+
+	select {
+	case <-ch:
+		t.Fatalf("stream closed early")
+	default:
+	}
+
+	cancel()
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Fatalf("unexpected result")
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("stream not closed after cancellation")
+	}
+}
+
+func TestPeersChanOverflow(t *testing.T) {
+	inet := mocknet.NewInternet(nil)
+
+	dhts, addrs, err := makeDHTsWithConfig(inet, 1, Config{PeerQueueLen: 4})
+	if err != nil {
+		t.Fatal()
+	}
+	defer stopDHTs(dhts)
+
+	d := dhts[0]
+	dhtAddr := mustResolve(addrs[0])
+	conn, err := inet.ListenUDP("udp", mustResolve("1.2.3.100:5555"))
+	if err != nil {
+		t.Fatal()
+	}
+	defer conn.Close()
+
+	ih := MustParseInfoHash("e2231dfe1d791ebfe619ec7f87ae1ca103b84239")
+	d.RequestPeers(ih, false, ImpliedPort)
+
+	id := GenerateNodeID()
+	msg := rawQuery(t, conn, dhtAddr, "get_peers", &krGetPeersReq{ID: id, InfoHash: ih})
+	token := msg.Response.(*krGetPeersRes).Token
+
+	// Announcements keep being answered while nobody reads PeersChan.
+	for i := 0; i < 20; i++ {
+		msg := rawQuery(t, conn, dhtAddr, "announce_peer", &krAnnouncePeerReq{
+			ID:       id,
+			InfoHash: ih,
+			Port:     6881 + i,
+			Token:    token,
+		})
+		if msg.Type != "r" {
+			t.Fatalf("announce_peer failed: %v", msg)
+		}
+	}
+
+	// The oldest results were dropped. One result may have been awaiting
+	// delivery outside the queue.
+	var ports []int
+loop:
+	for {
+		select {
+		case p := <-d.PeersChan():
+			ports = append(ports, p.Addr.Port)
+		case <-time.After(100 * time.Millisecond):
+			break loop
+		}
+	}
+
+	if len(ports) < 4 || ports[len(ports)-1] != 6881+19 || len(ports)+int(d.DroppedPeers()) != 20 {
+		t.Fatalf("unexpected results: %v, %d dropped", ports, d.DroppedPeers())
+	}
+}
+
+func TestDatumChanOverflow(t *testing.T) {
+	inet := mocknet.NewInternet(nil)
+
+	dhts, _, err := makeDHTs(inet, 1)
+	if err != nil {
+		t.Fatal()
+	}
+	defer stopDHTs(dhts)
+
+	// With no nodes known, each search concludes at once. Searches keep being
+	// served while nobody reads DatumChan.
+	d := dhts[0]
+	for i := 0; i < 20; i++ {
+		err := d.RequestDatum(ImmutableTarget([]byte(fmt.Sprintf("i%de", i))))
+		if err != nil {
+			t.Fatal()
+		}
+	}
+
+	waitFor(t, "results to be dropped", func() bool {
+		return d.DroppedData() == 10
+	})
+
+	n := 0
+loop:
+	for {
+		select {
+		case <-d.DatumChan():
+			n++
+		case <-time.After(100 * time.Millisecond):
+			break loop
+		}
+	}
+
+	if n != 10 {
+		t.Fatalf("%d results", n)
+	}
+}
+
+type closeRecordingConn struct {
+	denet.UDPConn
+	closed uint32
+}
+
+func (c *closeRecordingConn) Close() error {
+	atomic.StoreUint32(&c.closed, 1)
+	return c.UDPConn.Close()
+}
+
+func TestStop(t *testing.T) {
+	inet := mocknet.NewInternet(nil)
+
+	var conn *closeRecordingConn
+	d, err := New(&Config{
+		Address: "1.2.3.1:5555",
+		ListenFunc: func(cfg *Config) (denet.UDPConn, error) {
+			c, err := inet.ListenUDP("udp", mustResolve(cfg.Address))
+			conn = &closeRecordingConn{UDPConn: c}
+			return conn, err
+		},
+	})
+	if err != nil {
+		t.Fatal()
+	}
+
+	ih := MustParseInfoHash("e2231dfe1d791ebfe619ec7f87ae1ca103b84239")
+	ch, err := d.GetPeers(context.Background(), ih, nil)
+	if err != nil {
+		t.Fatal()
+	}
+
+	s, err := NewSearch(d, ih, true, 6881)
+	if err != nil {
+		t.Fatal()
+	}
+
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal()
+	}
+	w, err := d.WatchDatum(publicKey, nil, nil)
+	if err != nil {
+		t.Fatal()
+	}
+
+	// The socket is closed and the channels are closed by the time Stop
+	// returns, and standing requests have stopped.
+	d.Stop()
+	if atomic.LoadUint32(&conn.closed) == 0 {
+		t.Fatal("socket not closed")
+	}
+	for _, c := range []<-chan PeerResult{ch, d.PeersChan()} {
+		select {
+		case _, ok := <-c:
+			if ok {
+				t.Fatal("unexpected result")
+			}
+		default:
+			t.Fatal("peer channel not closed")
+		}
+	}
+	select {
+	case _, ok := <-w.Chan():
+		if ok {
+			t.Fatal("unexpected datum")
+		}
+	default:
+		t.Fatal("watch channel not closed")
+	}
+	for range d.LookupChan() {
+	}
+
+	// Further calls do not block.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		if d.Stop() != nil {
+			t.Error("second stop failed")
+		}
+		if err := AddHost(d, "1.2.3.2:5555", ""); err != ErrStopped {
+			t.Errorf("AddHost: %v", err)
+		}
+		d.AddNode(NodeLocator{Addr: *mustResolve("1.2.3.2:5555")})
+		s.Stop()
+		w.Stop()
+		if err := d.RequestPeers(ih, false, ImpliedPort); err != ErrStopped {
+			t.Errorf("RequestPeers: %v", err)
+		}
+		if _, err := d.GetPeers(context.Background(), ih, nil); err != ErrStopped {
+			t.Errorf("GetPeers: %v", err)
+		}
+		if _, err := NewSearch(d, ih, false, ImpliedPort); err != ErrStopped {
+			t.Errorf("NewSearch: %v", err)
+		}
+		if err := d.RequestDatum(ih); err != ErrStopped {
+			t.Errorf("RequestDatum: %v", err)
+		}
+		d.Forget(ih)
+		d.UnpublishDatum(ih)
+		if d.ListReachableNodes() != nil || d.ListAnnounces() != nil || d.ListPublishedData() != nil {
+			t.Error("unexpected result")
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(1 * time.Second):
+		t.Fatal("call blocked after stop")
+	}
+}
+
+// Advances clk in steps until f returns true, failing the test if it has not
+// done so within limit of clock time. Returns the clock time taken.
+func advanceUntil(t *testing.T, clk *testClock, step, limit time.Duration, f func() bool) time.Duration {
+	start := clk.Now()
+	for !f() {
+		elapsed := clk.Now().Sub(start)
+		if elapsed >= limit {
+			t.Fatalf("condition not met after %v", elapsed)
+		}
+
+		clk.Advance(step)
+
+		// Give the DHT a chance to act on any ticks.
+		time.Sleep(1 * time.Millisecond)
+	}
+
+	return clk.Now().Sub(start)
+}
+
+func TestReannounceRetry(t *testing.T) {
+	inet := mocknet.NewInternet(nil)
+	clk := newTestClock()
+
+	// Queries in flight when the clock is advanced should not time out.
+	dhts, addrs := makeChainWithConfig(t, inet, 5, Config{
+		Clock:        clk,
+		QueryTimeout: 1 * time.Minute,
+	})
+	defer stopDHTs(dhts)
+
+	// A node which knows of no others yet. Its node ID is fixed, as a change
+	// of ID would also cause it to announce again.
+	d, err := createDHT(inet, &Config{
+		Address:      "1.2.3.100:5555",
+		NodeID:       GenerateNodeID(),
+		Clock:        clk,
+		QueryTimeout: 1 * time.Minute,
+	})
+	if err != nil {
+		t.Fatal()
+	}
+	defer d.Stop()
+
+	ih := MustParseInfoHash("e2231dfe1d791ebfe619ec7f87ae1ca103b84239")
+	err = d.RequestPeers(ih, true, 6881)
+	if err != nil {
+		t.Fatal()
+	}
+
+	// Announcements which reach nobody are retried with increasing delays
+	// rather than after the full reannounce period.
+	nextAnnounce := func(minWait, maxWait time.Duration) time.Duration {
+		info := d.ListAnnounces()
+		if len(info) != 1 {
+			t.Fatalf("unexpected info: %+v", info)
+		}
+
+		wait := info[0].NextAnnounce.Sub(clk.Now())
+		if wait < minWait || wait > maxWait {
+			t.Fatalf("next announcement in %v", wait)
+		}
+		return wait
+	}
+
+	result := func() AnnounceResult {
+		select {
+		case res := <-d.AnnounceChan():
+			return res
+		case <-time.After(10 * time.Second):
+			t.Fatalf("announce did not finish")
+			return AnnounceResult{}
+		}
+	}
+
+	if res := result(); res.NumQueried != 0 {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+
+	clk.Advance(nextAnnounce(4500*time.Millisecond, 5500*time.Millisecond))
+	if res := result(); res.NumQueried != 0 {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+	nextAnnounce(9*time.Second, 11*time.Second)
+
+	d.AddNode(NodeLocator{Addr: *mustResolve(addrs[0])})
+	waitFor(t, "routing table to populate", func() bool {
+		return len(d.ListReachableNodes()) >= len(dhts)-1
+	})
+
+	// Further requests do not bring the retry forward.
+	for i := 0; i < 10; i++ {
+		err = d.RequestPeers(ih, true, 6881)
+		if err != nil {
+			t.Fatal()
+		}
+	}
+	select {
+	case res := <-d.AnnounceChan():
+		t.Fatalf("unexpected announce: %+v", res)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	clk.Advance(nextAnnounce(9*time.Second, 11*time.Second))
+	if res := result(); res.NumAccepted == 0 {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+
+	// Once an announcement succeeds, the full period applies again.
+	info := d.ListAnnounces()
+	if wait := info[0].NextAnnounce.Sub(clk.Now()); wait < 13*time.Minute {
+		t.Fatalf("next announcement in %v", wait)
+	}
+}
@@ -41,6 +41,12 @@ func getNodeID(msg *krpc.Message) NodeID {
 	return hni.GetNodeID()
 }
 
+// Implemented by query argument types.
+type krQueryArgs interface {
+	// Returns true iff all required arguments are present and well-formed.
+	Valid() bool
+}
+
 // KRPC "ping" request/response.
 type krPing struct {
 	ID NodeID `bencode:"id"`
@@ -54,6 +60,10 @@ func (m *krPing) GetNodeID() NodeID {
 	return m.ID
 }
 
+func (m *krPing) Valid() bool {
+	return m.ID.Valid()
+}
+
 // KRPC "find_node" request.
 type krFindNodeReq struct {
 	ID     NodeID   `bencode:"id"`
@@ -69,6 +79,10 @@ func (m *krFindNodeReq) GetNodeID() NodeID {
 	return m.ID
 }
 
+func (m *krFindNodeReq) Valid() bool {
+	return m.ID.Valid() && m.Target.Valid()
+}
+
 // KRPC "find_node" response.
 type krFindNodeRes struct {
 	ID     NodeID      `bencode:"id"`
@@ -99,6 +113,10 @@ func (m *krGetPeersReq) GetNodeID() NodeID {
 	return m.ID
 }
 
+func (m *krGetPeersReq) Valid() bool {
+	return m.ID.Valid() && m.InfoHash.Valid()
+}
+
 // KRPC "get_peers" response.
 type krGetPeersRes struct {
 	ID        NodeID          `bencode:"id"`
@@ -137,6 +155,11 @@ func (m *krAnnouncePeerReq) GetNodeID() NodeID {
 	return m.ID
 }
 
+func (m *krAnnouncePeerReq) Valid() bool {
+	return m.ID.Valid() && m.InfoHash.Valid() && len(m.Token) > 0 &&
+		(m.ImpliedPort != 0 || (m.Port > 0 && m.Port <= 65535))
+}
+
 // KRPC "announce_peer" response.
 type krAnnouncePeerRes struct {
 	ID NodeID `bencode:"id"`
@@ -162,13 +185,17 @@ func (m *krGetReq) GetNodeID() NodeID {
 	return m.ID
 }
 
+func (m *krGetReq) Valid() bool {
+	return m.ID.Valid() && m.Target.Valid()
+}
+
 // KRPC "get" response.
 type krGetRes struct {
-	ID     NodeID      `bencode:"id"`
-	Nodes  krNodesIPv4 `bencode:"nodes,omitempty"`
-	Nodes6 krNodesIPv6 `bencode:"nodes6,omitempty"`
-	Token  []byte      `bencode:"token"`
-	Value  string      `bencode:"v"`
+	ID     NodeID             `bencode:"id"`
+	Nodes  krNodesIPv4        `bencode:"nodes,omitempty"`
+	Nodes6 krNodesIPv6        `bencode:"nodes6,omitempty"`
+	Token  []byte             `bencode:"token"`
+	Value  bencode.RawMessage `bencode:"v,omitempty"` // Bencoded value
 
 	// For mutable values only.
 	Key        krPublicKey `bencode:"k,omitempty"`   // 32 bytes
@@ -182,9 +209,9 @@ func (m *krGetRes) GetNodeID() NodeID {
 
 // KRPC "put" request.
 type krPutReq struct {
-	ID    NodeID `bencode:"id"`
-	Token []byte `bencode:"token"`
-	Value string `bencode:"v"`
+	ID    NodeID             `bencode:"id"`
+	Token []byte             `bencode:"token"`
+	Value bencode.RawMessage `bencode:"v"` // Bencoded value
 
 	// For mutable values only.
 	Key        krPublicKey `bencode:"k,omitempty"`    // 32-byte Ed25519 public key
@@ -198,6 +225,24 @@ func (m *krPutReq) GetNodeID() NodeID {
 	return m.ID
 }
 
+func (m *krPutReq) Valid() bool {
+	return m.ID.Valid() && len(m.Token) > 0 && len(m.Value) > 0
+}
+
+// Returns the datum being put. The signature is not included.
+func (m *krPutReq) datum() *Datum {
+	d := &Datum{
+		Value: m.Value,
+		Key:   m.Key,
+		Salt:  m.Salt,
+	}
+	if m.SequenceNo != nil {
+		d.SequenceNo = *m.SequenceNo
+	}
+
+	return d
+}
+
 // KRPC "put" response.
 type krPutRes struct {
 	ID NodeID `bencode:"id"`
@@ -21,13 +21,13 @@ var tests = []test{
 		B:      `d1:rd2:id20:....................e1:t4:abcd1:y1:re`,
 		Method: "ping",
 	},
-	// find_nodes q/r
+	// find_node q/r
 	{
-		B: `d1:q10:find_nodes1:ad4:wantl2:n42:n6e2:id20:....................6:target20:,,,,,,,,,,,,,,,,,,,,e1:t4:abcd1:y1:qe`,
+		B: `d1:q9:find_node1:ad4:wantl2:n42:n6e2:id20:....................6:target20:,,,,,,,,,,,,,,,,,,,,e1:t4:abcd1:y1:qe`,
 	},
 	{
 		B:      `d1:rd2:id20:....................5:nodes52:!!!!!!!!!!!!!!!!!!!!<<<<>>!!!!!!!!!!!!!!!!!!!!<<<<>>e1:t4:abcd1:y1:re`,
-		Method: "find_nodes",
+		Method: "find_node",
 	},
 	// get_peers q/r
 	{
@@ -0,0 +1,99 @@
+package krpc
+
+import (
+	"fmt"
+	"github.com/hlandauf/bencode"
+)
+
+// A KRPC error code, as defined by BEP 5 and BEP 44.
+type ErrorCode int
+
+const (
+	ErrorCodeGeneric       ErrorCode = 201
+	ErrorCodeServer        ErrorCode = 202
+	ErrorCodeProtocol      ErrorCode = 203 // Malformed packet, invalid arguments or bad token.
+	ErrorCodeMethodUnknown ErrorCode = 204
+
+	// BEP 44.
+	ErrorCodeValueTooLarge    ErrorCode = 205
+	ErrorCodeInvalidSignature ErrorCode = 206
+	ErrorCodeSaltTooLarge     ErrorCode = 207
+	ErrorCodeCASMismatch      ErrorCode = 301
+	ErrorCodeSequenceNumber   ErrorCode = 302 // Sequence number less than current.
+)
+
+var errorCodeNames = map[ErrorCode]string{
+	ErrorCodeGeneric:          "Generic Error",
+	ErrorCodeServer:           "Server Error",
+	ErrorCodeProtocol:         "Protocol Error",
+	ErrorCodeMethodUnknown:    "Method Unknown",
+	ErrorCodeValueTooLarge:    "Message Too Big",
+	ErrorCodeInvalidSignature: "Invalid Signature",
+	ErrorCodeSaltTooLarge:     "Salt Too Big",
+	ErrorCodeCASMismatch:      "CAS Mismatch",
+	ErrorCodeSequenceNumber:   "Sequence Number Less Than Current",
+}
+
+func (c ErrorCode) String() string {
+	if name, ok := errorCodeNames[c]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("Error %d", int(c))
+}
+
+// A KRPC error, as carried in the "e" field of an error message. It is encoded
+// as a list of an integer code and a string message.
+type Error struct {
+	Code    ErrorCode
+	Message string
+}
+
+// Returns a new error with the given code. If the message is empty, the
+// standard description of the code is used.
+func NewError(code ErrorCode, message string) *Error {
+	if message == "" {
+		message = code.String()
+	}
+
+	return &Error{Code: code, Message: message}
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("KRPC error %d: %s", int(e.Code), e.Message)
+}
+
+func (e Error) MarshalBencode() ([]byte, error) {
+	return bencode.EncodeBytes([]interface{}{int(e.Code), e.Message})
+}
+
+func (e *Error) UnmarshalBencode(b []byte) error {
+	var parts []bencode.RawMessage
+	err := bencode.DecodeBytes(b, &parts)
+	if err != nil {
+		return err
+	}
+
+	if len(parts) != 2 {
+		return fmt.Errorf("error must be a list of two items, not %d", len(parts))
+	}
+
+	var code int64
+	err = bencode.DecodeBytes(parts[0], &code)
+	if err != nil || len(parts[0]) == 0 || parts[0][0] != 'i' {
+		return fmt.Errorf("error code must be an integer")
+	}
+
+	var message string
+	err = bencode.DecodeBytes(parts[1], &message)
+	if err != nil || len(parts[1]) == 0 || parts[1][0] < '0' || parts[1][0] > '9' {
+		return fmt.Errorf("error message must be a string")
+	}
+
+	*e = Error{
+		Code:    ErrorCode(code),
+		Message: message,
+	}
+
+	return nil
+}
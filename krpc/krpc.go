@@ -27,7 +27,7 @@ type Message struct {
 	Response  interface{}        `bencode:"-"`           // Responses: Response value.
 	Response_ bencode.RawMessage `bencode:"r,omitempty"` // (Internal use only.)
 
-	Error []interface{} `bencode:"e,omitempty"` // Error responses: error information.
+	Error *Error `bencode:"e,omitempty"` // Error responses: error information.
 
 	IP Endpoint `bencode:"ip,omitempty"`
 }
@@ -79,6 +79,8 @@ func MakeQuery(method string, args interface{}) (*Message, error) {
 	return &msg, nil
 }
 
+// Send a response to a query. The remote address is echoed back in the "ip"
+// field, as per BEP 42.
 func WriteResponse(conn denet.UDPConn, remoteAddr net.UDPAddr, q *Message, response interface{}) error {
 	responseb, err := bencode.EncodeBytes(response)
 	if err != nil {
@@ -89,18 +91,20 @@ func WriteResponse(conn denet.UDPConn, remoteAddr net.UDPAddr, q *Message, respo
 		TxID:      q.TxID,
 		Type:      "r",
 		Response_: responseb,
+		IP:        Endpoint(remoteAddr),
 	}
 
 	return Write(conn, remoteAddr, &msg)
 }
 
-func WriteError(conn denet.UDPConn, remoteAddr net.UDPAddr, q *Message, errorCode int, errorMessage string) error {
+// Send an error in response to a query. The remote address is echoed back in
+// the "ip" field, as per BEP 42.
+func WriteError(conn denet.UDPConn, remoteAddr net.UDPAddr, q *Message, err *Error) error {
 	msg := Message{
-		TxID: q.TxID,
-		Type: "e",
-		Error: []interface{}{
-			errorCode, errorMessage,
-		},
+		TxID:  q.TxID,
+		Type:  "e",
+		Error: err,
+		IP:    Endpoint(remoteAddr),
 	}
 
 	return Write(conn, remoteAddr, &msg)
@@ -118,6 +122,9 @@ func Write(conn denet.UDPConn, remoteAddr net.UDPAddr, msg *Message) error {
 	return err
 }
 
+// Decode a message. If the message is a query for an unregistered method or
+// with malformed arguments, the message is returned along with a *Error which
+// should be sent in reply.
 func Decode(b []byte) (msg *Message, err error) {
 	err = bencode.DecodeBytes(b, &msg)
 	if err != nil {
@@ -125,8 +132,19 @@ func Decode(b []byte) (msg *Message, err error) {
 		return
 	}
 
-	if msg.Type == "q" {
-		msg.Args, err = decodeByType(msg.Args_, queryTypes[msg.Method])
+	switch msg.Type {
+	case "q":
+		valueType, ok := queryTypes[msg.Method]
+		msg.Args, err = decodeByType(msg.Args_, valueType)
+		if err != nil {
+			err = NewError(ErrorCodeProtocol, "malformed arguments")
+		} else if !ok {
+			err = NewError(ErrorCodeMethodUnknown, "")
+		}
+	case "e":
+		if msg.Error == nil {
+			err = fmt.Errorf("error message without error")
+		}
 	}
 	// msg.Type == "r": Must decode later using ResponseAsMethod.
 
@@ -0,0 +1,88 @@
+package krpc
+
+import (
+	"github.com/hlandau/degoutils/net/mocknet"
+	"github.com/hlandauf/bencode"
+	"net"
+	"testing"
+)
+
+func TestReplyIP(t *testing.T) {
+	inet := mocknet.NewInternet(nil)
+
+	addrA := net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 1234}
+	addrB := net.UDPAddr{IP: net.ParseIP("5.6.7.8"), Port: 5678}
+
+	connA, err := inet.ListenUDP("udp", &addrA)
+	if err != nil {
+		t.Fatal()
+	}
+	defer connA.Close()
+
+	connB, err := inet.ListenUDP("udp", &addrB)
+	if err != nil {
+		t.Fatal()
+	}
+	defer connB.Close()
+
+	q, err := MakeQuery("ping", map[string]string{"id": "01234567890123456789"})
+	if err != nil {
+		t.Fatal()
+	}
+
+	writes := []func() error{
+		func() error {
+			return WriteResponse(connA, addrB, q, map[string]string{"id": "98765432109876543210"})
+		},
+		func() error {
+			return WriteError(connA, addrB, q, NewError(ErrorCodeGeneric, ""))
+		},
+	}
+
+	for _, write := range writes {
+		err = write()
+		if err != nil {
+			t.Fatalf("cannot write: %v", err)
+		}
+
+		msg, _, err := Read(connB)
+		if err != nil {
+			t.Fatalf("cannot read: %v", err)
+		}
+
+		if msg.TxID != q.TxID || !msg.IP.IP.Equal(addrB.IP) || msg.IP.Port != addrB.Port {
+			t.Fatalf("reply does not carry requester address: %v %v", msg, msg.IP)
+		}
+	}
+}
+
+func TestError(t *testing.T) {
+	msg, err := Decode([]byte("d1:eli203e14:Protocol Errore1:t2:aa1:y1:ee"))
+	if err != nil {
+		t.Fatalf("cannot decode: %v", err)
+	}
+
+	if msg.Error == nil || msg.Error.Code != ErrorCodeProtocol || msg.Error.Message != "Protocol Error" {
+		t.Fatalf("unexpected error: %v", msg.Error)
+	}
+
+	b, err := bencode.EncodeBytes(NewError(ErrorCodeMethodUnknown, ""))
+	if err != nil || string(b) != "li204e14:Method Unknowne" {
+		t.Fatalf("unexpected encoding: %q %v", b, err)
+	}
+
+	malformed := []string{
+		"d1:eli203ee1:t2:aa1:y1:ee",
+		"d1:eli203e3:abci1ee1:t2:aa1:y1:ee",
+		"d1:el3:abc3:abce1:t2:aa1:y1:ee",
+		"d1:eli203ei1ee1:t2:aa1:y1:ee",
+		"d1:e3:abc1:t2:aa1:y1:ee",
+		"d1:t2:aa1:y1:ee",
+	}
+	for _, m := range malformed {
+		_, err = Decode([]byte(m))
+		if err == nil {
+			t.Fatalf("malformed error accepted: %q", m)
+		}
+	}
+}
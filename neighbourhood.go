@@ -8,27 +8,40 @@ type neighbourhood struct {
 	nodeID       NodeID
 	boundaryNode *node
 	proximity    int // How many prefix bits are shared between boundaryNode and nodeID.
+
+	// If set, closer nodes displace boundaryNode. Not used with k-buckets,
+	// which do their own replacement.
+	displaceBoundary bool
 }
 
-func newNeighbourhood(nodeID NodeID) *neighbourhood {
+func newNeighbourhood(cfg *Config) *neighbourhood {
 	return &neighbourhood{
-		routingTable: newRoutingTable(),
-		nodeID:       nodeID,
+		routingTable: newRoutingTable(cfg.RoutingTable, cfg.NodeID, cfg.Clock,
+			cfg.NodeIDPolicy == NodeIDPolicyEnforce),
+		nodeID:           cfg.NodeID,
+		displaceBoundary: cfg.RoutingTable != RoutingTableKBuckets,
 	}
 }
 
+// Change the node ID around which the neighbourhood is maintained.
+func (nh *neighbourhood) SetNodeID(nodeID NodeID) {
+	nh.nodeID = nodeID
+	nh.routingTable.SetNodeID(nodeID)
+	nh.resetBoundary()
+}
+
 // Remove peer from routing table.
 func (nh *neighbourhood) Remove(n *node) {
 	nh.routingTable.Remove(n)
 
-	if n.NodeID == nh.boundaryNode.NodeID {
+	if nh.displaceBoundary && nh.boundaryNode != nil && n.NodeID == nh.boundaryNode.NodeID {
 		nh.resetBoundary()
 	}
 }
 
 func (nh *neighbourhood) resetBoundary() {
 	nh.proximity = 0
-	neighbours := nh.routingTable.routingTree.Lookup(InfoHash(nh.nodeID))
+	neighbours := nh.routingTable.Lookup(InfoHash(nh.nodeID))
 	if len(neighbours) > 0 {
 		nh.boundaryNode = neighbours[len(neighbours)-1]
 		nh.proximity = commonBits([]byte(nh.nodeID), []byte(nh.boundaryNode.NodeID))
@@ -38,6 +51,10 @@ func (nh *neighbourhood) resetBoundary() {
 // Update the routing table if the peer p is closer than the eight nodes in our
 // neighbourhood, by replacing the most distant one (boundaryNode).
 func (nh *neighbourhood) Upkeep(n *node) {
+	if !nh.displaceBoundary {
+		return
+	}
+
 	if nh.boundaryNode == nil {
 		nh.addNewNeighbour(n, false)
 		return
@@ -61,18 +78,20 @@ func (nh *neighbourhood) Upkeep(n *node) {
 }
 
 func (nh *neighbourhood) addNewNeighbour(n *node, displaceBoundary bool) {
-	if displaceBoundary && nh.boundaryNode != nil {
+	// A node awaiting responses is kept until they arrive, lest they be
+	// discarded as coming from an unknown node.
+	if displaceBoundary && nh.boundaryNode != nil && nh.boundaryNode.NumPendingQueries() == 0 {
 		nh.Remove(nh.boundaryNode)
 	} else {
 		nh.resetBoundary()
 	}
 }
 
-func (nh *neighbourhood) Cleanup(period time.Duration) (nodesToBePinged []*node) {
+func (nh *neighbourhood) Cleanup(period time.Duration, now time.Time) (nodesToBePinged []*node) {
 	nh.routingTable.Visit(func(n *node) error {
-		if n.IsExpired(period) {
+		if n.IsExpired(period, now) {
 			nh.Remove(n)
-		} else if n.NeedsPing(period) {
+		} else if n.NeedsPing(period, now) {
 			nodesToBePinged = append(nodesToBePinged, n)
 		}
 
@@ -0,0 +1,30 @@
+package dht
+
+import (
+	"github.com/hlandau/goutils/clock"
+	"testing"
+	"time"
+)
+
+func TestNeighbourhoodCleanup(t *testing.T) {
+	cfg := Config{NodeID: GenerateNodeID(), Clock: clock.Real}
+	cfg.setDefaults()
+	nh := newNeighbourhood(&cfg)
+
+	expired, _ := nh.routingTable.Node(GenerateNodeID(), *mustResolve("1.2.3.4:5555"))
+	expired.NumFailures = maxNodeFailures
+
+	live, _ := nh.routingTable.Node(GenerateNodeID(), *mustResolve("1.2.3.5:5555"))
+	live.LastRxTime = time.Now()
+
+	nh.Cleanup(cfg.CleanupPeriod, time.Now())
+
+	if nh.routingTable.Size() != 1 || nh.routingTable.FindByAddress(live.Addr) != live {
+		t.Fatal()
+	}
+	for _, n := range nh.routingTable.Lookup(InfoHash(cfg.NodeID)) {
+		if n == expired {
+			t.Fatal("expired node still routable")
+		}
+	}
+}
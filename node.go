@@ -7,13 +7,38 @@ import (
 	"time"
 )
 
+// Number of consecutive failed queries after which a node is expired.
+const maxNodeFailures = 3
+
+// Number of consecutive error responses after which a node is expired.
+const maxNodeErrors = 5
+
+const (
+	// Retransmission timeout used for nodes whose RTT is not yet known.
+	initialRTO = 1 * time.Second
+
+	// Lower bound on the retransmission timeout.
+	minRTO = 250 * time.Millisecond
+)
+
 // Represents a known node in the DHT.
 type node struct {
 	Addr   net.UDPAddr // The address of the peer.
 	NodeID NodeID      // May be invalid if not yet known.
 
-	// Outgoing queries for which we are awaiting a response.
-	PendingQueries map[string]*krpc.Message
+	// Outgoing queries for which we are awaiting a response, by transaction ID.
+	PendingQueries map[string]*pendingQuery
+
+	// Number of consecutive queries to this node which have timed out.
+	NumFailures int
+
+	// Number of consecutive queries to this node which have been answered with
+	// an error.
+	NumErrors int
+
+	// Smoothed round-trip time and its mean deviation, as per RFC 6298. Zero
+	// if no RTT sample has been taken yet.
+	SRTT, RTTVar time.Duration
 
 	// Time of last incoming message from this peer.
 	LastRxTime time.Time
@@ -22,15 +47,110 @@ type node struct {
 	PastQueries map[InfoHash]time.Time
 }
 
+// An outgoing query awaiting a response.
+type pendingQuery struct {
+	Query *krpc.Message
+
+	// The query is deemed to have failed if no response has been received by
+	// this time.
+	Deadline time.Time
+
+	// When the query was first sent.
+	SentTime time.Time
+
+	// When the query is next to be retransmitted if no response has been
+	// received, and the timeout used to determine it. The timeout doubles with
+	// each retransmission.
+	RetransmitTime time.Time
+	RTO            time.Duration
+
+	// Number of times the query has been retransmitted.
+	NumRetransmits int
+
+	// For an announce_peer query, the announcement it was sent for.
+	Announce *announce
+}
+
 func newNode(addr net.UDPAddr, nodeID NodeID) *node {
 	return &node{
 		Addr:           addr,
 		NodeID:         nodeID,
-		PendingQueries: make(map[string]*krpc.Message),
+		PendingQueries: make(map[string]*pendingQuery),
 		PastQueries:    make(map[InfoHash]time.Time),
 	}
 }
 
+// Returns true iff the node's ID is permitted for its IP under BEP 42.
+func (n *node) HasSecureID() bool {
+	return nodeIDIsSecure(n.Addr.IP, n.NodeID)
+}
+
+// Returns the smoothed round-trip time to the node, or zero if unknown.
+func (n *node) RTT() time.Duration {
+	return n.SRTT
+}
+
+// Returns the retransmission timeout for a query to the node.
+func (n *node) RTO() time.Duration {
+	if n.SRTT == 0 {
+		return initialRTO
+	}
+
+	rto := n.SRTT + 4*n.RTTVar
+	if rto < minRTO {
+		rto = minRTO
+	}
+
+	return rto
+}
+
+// Update the smoothed RTT with a new sample.
+func (n *node) AddRTTSample(rtt time.Duration) {
+	if n.SRTT == 0 {
+		n.SRTT = rtt
+		n.RTTVar = rtt / 2
+		return
+	}
+
+	delta := n.SRTT - rtt
+	if delta < 0 {
+		delta = -delta
+	}
+
+	n.RTTVar = (3*n.RTTVar + delta) / 4
+	n.SRTT = (7*n.SRTT + rtt) / 8
+}
+
+// The state of a node for the purposes of routing, as defined by BEP 5.
+type nodeState int
+
+const (
+	nodeGood nodeState = iota
+	nodeQuestionable
+	nodeBad
+)
+
+// Time since the last incoming message after which a good node becomes
+// questionable.
+const nodeGoodPeriod = 15 * time.Minute
+
+// Number of consecutive failed queries after which a node is deemed bad.
+const nodeBadFailures = 2
+
+// Returns the state of the node at the given time. A node is good if it has
+// responded to us within nodeGoodPeriod, and bad if it has failed to respond
+// to several queries in a row.
+func (n *node) State(now time.Time) nodeState {
+	switch {
+	case n.NumFailures >= nodeBadFailures:
+		return nodeBad
+	case n.IsReachable() && now.Sub(n.LastRxTime) < nodeGoodPeriod:
+		return nodeGood
+	default:
+		return nodeQuestionable
+	}
+}
+
 func (p *node) IsReachable() bool {
 	return !p.LastRxTime.IsZero()
 }
@@ -41,12 +161,16 @@ func (p *node) NumPendingQueries() int {
 
 // Returns true iff the node is due for expiry because of unanswered queries or
 // because it has not been heard from.
-func (n *node) IsExpired(cleanupPeriod time.Duration) bool {
+func (n *node) IsExpired(cleanupPeriod time.Duration, now time.Time) bool {
 	if !n.IsReachable() && n.NumPendingQueries() > 2 {
 		return true
 	}
 
-	timeSince := time.Since(n.LastRxTime)
+	if n.NumFailures >= maxNodeFailures || n.NumErrors >= maxNodeErrors {
+		return true
+	}
+
+	timeSince := now.Sub(n.LastRxTime)
 	if timeSince > (2*cleanupPeriod + 1*time.Minute) {
 		return true
 	}
@@ -56,19 +180,19 @@ func (n *node) IsExpired(cleanupPeriod time.Duration) bool {
 
 // Returns true iff the node is due for ping. It is assumed this function will
 // only be called after checking that IsExpired() is false.
-func (n *node) NeedsPing(cleanupPeriod time.Duration) bool {
+func (n *node) NeedsPing(cleanupPeriod time.Duration, now time.Time) bool {
 	if !n.IsReachable() || n.NumPendingQueries() == 0 {
 		return true
 	}
 
-	timeSince := time.Since(n.LastRxTime)
+	timeSince := now.Sub(n.LastRxTime)
 	return timeSince >= cleanupPeriod/2
 }
 
 // Returns true if a node was contacted recently in relation to some infohash.
-func (n *node) WasContactedRecently(infoHash InfoHash, searchRetryPeriod time.Duration) bool {
+func (n *node) WasContactedRecently(infoHash InfoHash, searchRetryPeriod time.Duration, now time.Time) bool {
 	t, ok := n.PastQueries[infoHash]
-	return ok && time.Since(t) < searchRetryPeriod
+	return ok && now.Sub(t) < searchRetryPeriod
 }
 
 func (n *node) MarkContacted(c clock.Clock, infoHash InfoHash) {
@@ -0,0 +1,27 @@
+package dht
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNodeRTT(t *testing.T) {
+	n := newNode(*mustResolve("1.2.3.4:5555"), "")
+
+	if n.RTT() != 0 || n.RTO() != initialRTO {
+		t.Fatal()
+	}
+
+	n.AddRTTSample(400 * time.Millisecond)
+	if n.RTT() != 400*time.Millisecond || n.RTO() != 1200*time.Millisecond {
+		t.Fatalf("%v %v", n.RTT(), n.RTO())
+	}
+
+	// Consistent fast responses should bring the timeout down to the minimum.
+	for i := 0; i < 50; i++ {
+		n.AddRTTSample(10 * time.Millisecond)
+	}
+	if n.RTT() > 20*time.Millisecond || n.RTO() != minRTO {
+		t.Fatalf("%v %v", n.RTT(), n.RTO())
+	}
+}
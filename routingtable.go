@@ -1,22 +1,73 @@
 package dht
 
-import "net"
+import (
+	"github.com/hlandau/goutils/clock"
+	"net"
+)
+
+// Selects the structure used to find the nodes nearest to a given ID.
+type RoutingTableKind int
+
+const (
+	// A bucketless binary tree holding every known node.
+	RoutingTableTrie RoutingTableKind = iota
+
+	// A Kademlia k-bucket table, as described in BEP 5. Buckets are split
+	// around our own ID, and each has a replacement cache.
+	RoutingTableKBuckets
+)
+
+// A structure used to find the nodes nearest to a given ID. Implemented by
+// bucketTable and routingTree.
+type routingIndex interface {
+	Insert(n *node)
+	Remove(n *node)
+	Lookup(infoHash InfoHash) []*node
+	LookupFiltered(infoHash InfoHash, filterFunc func(infoHash InfoHash, n *node) bool) []*node
+
+	// Called when our own node ID changes.
+	SetNodeID(nodeID NodeID)
+}
 
 type routingTable struct {
-	routingTree *routingTree
+	index routingIndex
 
 	// The keys are of the format "IP:port", representing UDP addresses.
 	// The hostname must be an IP, not a name.
 	addresses map[string]*node
+
+	// If set, nodes whose IDs do not match their IP under BEP 42 are kept out
+	// of the table.
+	enforceSecureIDs bool
 }
 
-func newRoutingTable() *routingTable {
+func newRoutingTable(kind RoutingTableKind, nodeID NodeID, clock clock.Clock, enforceSecureIDs bool) *routingTable {
+	var index routingIndex
+	switch kind {
+	case RoutingTableKBuckets:
+		index = newBucketTable(nodeID, clock)
+	default:
+		index = &routingTree{}
+	}
+
 	return &routingTable{
-		routingTree: &routingTree{},
-		addresses:   make(map[string]*node),
+		index:            index,
+		addresses:        make(map[string]*node),
+		enforceSecureIDs: enforceSecureIDs,
 	}
 }
 
+// Returns true iff the node may be kept in the table. Nodes whose IDs are not
+// yet known are kept until they are.
+func (rt *routingTable) isAcceptable(n *node) bool {
+	return !rt.enforceSecureIDs || !n.NodeID.Valid() || n.HasSecureID()
+}
+
+// Returns true iff the node may be inserted into the index.
+func (rt *routingTable) isRoutable(n *node) bool {
+	return n.NodeID.Valid() && rt.isAcceptable(n)
+}
+
 // Looks up a peer by IP:port. Returns nil if no such peer is found.
 func (rt *routingTable) FindByAddress(addr net.UDPAddr) *node {
 	n, _ := rt.addresses[addr.String()]
@@ -39,10 +90,14 @@ func (rt *routingTable) Insert(n *node) {
 		return //err
 	}
 
+	if !rt.isAcceptable(n) {
+		return
+	}
+
 	rt.addresses[n.Addr.String()] = n
 
-	if n.NodeID.Valid() {
-		rt.routingTree.Insert(n)
+	if rt.isRoutable(n) {
+		rt.index.Insert(n)
 	}
 }
 
@@ -52,8 +107,8 @@ func (rt *routingTable) Update(n *node) {
 		return //fmt.Errorf("peer not present in routing table: %v", p.Addr)
 	}
 
-	if n.NodeID.Valid() {
-		rt.routingTree.Insert(n)
+	if rt.isRoutable(n) {
+		rt.index.Insert(n)
 		//rt.addresses[n.Addr.String()].NodeID = n.NodeID
 	}
 }
@@ -73,7 +128,22 @@ func (rt *routingTable) Node(nodeID NodeID, addr net.UDPAddr) (n *node, wasInser
 
 func (rt *routingTable) Remove(n *node) {
 	delete(rt.addresses, n.Addr.String())
-	rt.routingTree.Cut(InfoHash(n.NodeID))
+	rt.index.Remove(n)
+}
+
+// Find the nodes nearest to the given infohash.
+func (rt *routingTable) Lookup(infoHash InfoHash) []*node {
+	return rt.index.Lookup(infoHash)
+}
+
+// Find the nodes nearest to the given infohash, filtered by filterFunc.
+func (rt *routingTable) LookupFiltered(infoHash InfoHash, filterFunc func(infoHash InfoHash, n *node) bool) []*node {
+	return rt.index.LookupFiltered(infoHash, filterFunc)
+}
+
+// Change our own node ID.
+func (rt *routingTable) SetNodeID(nodeID NodeID) {
+	rt.index.SetNodeID(nodeID)
 }
 
 func (rt *routingTable) Visit(f func(n *node) error) error {
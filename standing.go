@@ -1,14 +1,18 @@
 package dht
 
 import (
+	"fmt"
 	"sync"
 	"time"
 )
 
 // Represents a standing search request.
 type Search interface {
-	// Call to stop the search request. Results may still be returned.  May be
-	// called multiple times without consequence.
+	// Call to stop the search request. The DHT loses interest in the infohash
+	// and stops announcing for it unless other searches, or calls to
+	// RequestPeers or GetPeers, still hold them, though results already found
+	// may still be returned. Returns once the request has stopped being
+	// repeated. May be called multiple times without consequence.
 	Stop()
 }
 
@@ -16,20 +20,39 @@ type search struct {
 	dht      *DHT
 	stopChan chan struct{}
 	stopOnce sync.Once
+	doneChan chan struct{} // Closed once the loop has exited.
 
 	infoHash InfoHash
 	announce bool
+	port     int
 }
 
 func (s *search) loop() {
 	const searchFreq = 1 * time.Second
 
+	defer s.dht.loops.Done()
+	defer close(s.doneChan)
+
 	for {
-		s.dht.RequestPeers(s.infoHash, s.announce)
+		err := s.dht.requestPeers(requestPeersInfo{
+			InfoHash: s.infoHash,
+			Announce: s.announce,
+			Port:     s.port,
+			Cancel:   s.stopChan,
+			Search:   s,
+		})
+		if err == ErrStopped {
+			return
+		}
 
 		select {
 		case <-time.After(searchFreq):
 		case <-s.stopChan:
+			// Requests still queued are ignored, so none can be processed
+			// after this.
+			s.dht.forget(forgetInfo{InfoHash: s.infoHash, Interest: true, Search: s})
+			return
+		case <-s.dht.stopChan:
 			return
 		}
 	}
@@ -39,19 +62,183 @@ func (s *search) Stop() {
 	s.stopOnce.Do(func() {
 		close(s.stopChan)
 	})
+
+	<-s.doneChan
 }
 
 // Creates a new standing peer request. The request will be repeated as
-// appropriate until the desired number of peers has been found. Cancel the
-// request by calling Stop on the returned interface.
-func NewSearch(dht *DHT, infoHash InfoHash, announce bool) (Search, error) {
+// appropriate until the desired number of peers has been found. If announce is
+// set, this node is signed up as a peer on the given port, which may be
+// ImpliedPort. Cancel the request by calling Stop on the returned interface.
+func NewSearch(dht *DHT, infoHash InfoHash, announce bool, port int) (Search, error) {
+	if announce && (port < 0 || port > 65535) {
+		return nil, fmt.Errorf("invalid announce port: %d", port)
+	}
+
+	err := dht.addLoop()
+	if err != nil {
+		return nil, err
+	}
+
 	s := &search{
 		dht:      dht,
 		stopChan: make(chan struct{}),
+		doneChan: make(chan struct{}),
 
 		infoHash: infoHash,
 		announce: announce,
+		port:     port,
 	}
 	go s.loop()
 	return s, nil
 }
+
+// Represents a standing watch on a mutable datum.
+type Watch interface {
+	// Returns a channel on which each newer verified version of the datum is
+	// sent. The channel is closed once the watch has stopped.
+	Chan() <-chan *Datum
+
+	// Call to stop the watch. May be called multiple times without
+	// consequence.
+	Stop()
+}
+
+// Watch configuration.
+type WatchConfig struct {
+	// Interval at which the datum is polled after a change is seen. Defaults to
+	// 1 minute.
+	MinInterval time.Duration
+
+	// While the datum does not change, the polling interval doubles up to this
+	// limit. Defaults to 30 minutes.
+	MaxInterval time.Duration
+}
+
+func (cfg *WatchConfig) setDefaults() {
+	if cfg.MinInterval == 0 {
+		cfg.MinInterval = 1 * time.Minute
+	}
+
+	if cfg.MaxInterval == 0 {
+		cfg.MaxInterval = 30 * time.Minute
+	}
+
+	if cfg.MaxInterval < cfg.MinInterval {
+		cfg.MaxInterval = cfg.MinInterval
+	}
+}
+
+type watch struct {
+	dht       *DHT
+	cfg       WatchConfig
+	stopChan  chan struct{}
+	stopOnce  sync.Once
+	datumChan chan *Datum
+
+	target InfoHash
+	salt   []byte
+	seq    *uint64 // Sequence number of the newest version seen.
+}
+
+func (w *watch) loop() {
+	defer w.dht.loops.Done()
+	defer close(w.datumChan)
+
+	interval := w.cfg.MinInterval
+	resultChan := make(chan DatumResult, 1)
+
+	for {
+		select {
+		case w.dht.requestDatumChan <- requestDatumInfo{
+			Target:     w.target,
+			Salt:       w.salt,
+			Seq:        w.seq,
+			ResultChan: resultChan,
+		}:
+		case <-w.stopChan:
+			return
+		case <-w.dht.stopChan:
+			return
+		}
+
+		var res DatumResult
+		select {
+		case res = <-resultChan:
+		case <-w.stopChan:
+			return
+		case <-w.dht.stopChan:
+			return
+		}
+
+		d := res.Datum
+		if d != nil && d.IsMutable() && (w.seq == nil || d.SequenceNo > *w.seq) {
+			seq := d.SequenceNo
+			w.seq = &seq
+			interval = w.cfg.MinInterval
+
+			select {
+			case w.datumChan <- d:
+			case <-w.stopChan:
+				return
+			case <-w.dht.stopChan:
+				return
+			}
+		} else {
+			interval *= 2
+			if interval > w.cfg.MaxInterval {
+				interval = w.cfg.MaxInterval
+			}
+		}
+
+		select {
+		case <-w.dht.cfg.Clock.After(interval):
+		case <-w.stopChan:
+			return
+		case <-w.dht.stopChan:
+			return
+		}
+	}
+}
+
+func (w *watch) Chan() <-chan *Datum {
+	return w.datumChan
+}
+
+func (w *watch) Stop() {
+	w.stopOnce.Do(func() {
+		close(w.stopChan)
+	})
+}
+
+// Creates a new standing watch on the mutable datum stored under the given
+// Ed25519 public key and salt. The salt may be nil. The datum is polled
+// periodically and each version with a higher sequence number than the last
+// is sent on the watch's channel. Cancel the watch by calling Stop on the
+// returned interface. If cfg is nil, defaults are used.
+func (dht *DHT) WatchDatum(key, salt []byte, cfg *WatchConfig) (Watch, error) {
+	if !krPublicKey(key).IsWellFormed() {
+		return nil, fmt.Errorf("malformed public key")
+	}
+
+	err := dht.addLoop()
+	if err != nil {
+		return nil, err
+	}
+
+	w := &watch{
+		dht:       dht,
+		stopChan:  make(chan struct{}),
+		datumChan: make(chan *Datum),
+
+		target: MutableTarget(key, salt),
+		salt:   salt,
+	}
+	if cfg != nil {
+		w.cfg = *cfg
+	}
+	w.cfg.setDefaults()
+
+	go w.loop()
+	return w, nil
+}
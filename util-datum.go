@@ -1,8 +1,15 @@
 package dht
 
+import (
+	"crypto/ed25519"
+	"crypto/sha1"
+	"fmt"
+	"github.com/hlandauf/bencode"
+)
+
 // An arbitrary non-peer data item stored in the DHT.
 type Datum struct {
-	Value string // The datum value.
+	Value []byte // The datum value, in bencoded form. May be any bencoded value.
 
 	Key        krPublicKey // If set, this is a mutable datum.
 	Salt       []byte      // Salt. Only used for mutable data.
@@ -10,6 +17,132 @@ type Datum struct {
 	SequenceNo uint64      // Sequence number. Only used for mutable data.
 }
 
+// Maximum salt length for mutable data.
+const maxSaltLen = 64
+
+// Creates an immutable datum with the given bencoded value.
+func NewImmutableDatum(value []byte) (*Datum, error) {
+	err := checkDatumValue(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Datum{
+		Value: value,
+	}, nil
+}
+
+// Creates a mutable datum with the given bencoded value, salt and sequence
+// number, signed using the given Ed25519 private key. The salt may be nil.
+func NewMutableDatum(privateKey ed25519.PrivateKey, value []byte, salt []byte, sequenceNo uint64) (*Datum, error) {
+	if len(privateKey) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("malformed private key")
+	}
+
+	err := checkDatumValue(value)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(salt) > maxSaltLen {
+		return nil, fmt.Errorf("salt too large")
+	}
+
+	d := &Datum{
+		Value:      value,
+		Key:        krPublicKey(privateKey.Public().(ed25519.PublicKey)),
+		Salt:       salt,
+		SequenceNo: sequenceNo,
+	}
+
+	d.Signature = krSignature(ed25519.Sign(privateKey, d.signingBuffer()))
+	return d, nil
+}
+
+// Ensures that a value is a single well-formed bencoded value of acceptable
+// size.
+func checkDatumValue(value []byte) error {
+	if len(value) > maxPutLen {
+		return fmt.Errorf("datum value too large")
+	}
+
+	var v interface{}
+	err := bencode.DecodeBytes(value, &v)
+	if err != nil {
+		return fmt.Errorf("datum value is not valid bencode: %v", err)
+	}
+
+	// Reencoding catches trailing data. Dictionary key order may differ, but the
+	// length will not.
+	b, err := bencode.EncodeBytes(v)
+	if err != nil || len(b) != len(value) {
+		return fmt.Errorf("datum value is not a single bencoded value")
+	}
+
+	return nil
+}
+
+// Returns the target under which an immutable datum with the given bencoded
+// value is stored.
+func ImmutableTarget(value []byte) InfoHash {
+	h := sha1.New()
+	h.Write(value)
+	return InfoHash(string(h.Sum(nil)))
+}
+
+// Returns the target under which a mutable datum with the given Ed25519
+// public key and salt is stored. The salt may be nil.
+func MutableTarget(publicKey, salt []byte) InfoHash {
+	h := sha1.New()
+	h.Write(publicKey)
+	h.Write(salt)
+	return InfoHash(string(h.Sum(nil)))
+}
+
 func (d *Datum) IsMutable() bool {
 	return d.Key.IsWellFormed()
 }
+
+// Returns the target under which the datum is stored.
+func (d *Datum) target() InfoHash {
+	// Yes, it really is the case that mutable keys are hashed using the raw
+	// Ed25519 public key+salt whereas immutable keys are hashed using the
+	// bencoded value.
+	if d.IsMutable() {
+		return MutableTarget([]byte(d.Key), d.Salt)
+	}
+
+	return ImmutableTarget(d.Value)
+}
+
+// Returns the buffer over which the signature of a mutable datum is computed.
+// This is the bencoded salt, sequence number and value without the enclosing
+// dictionary.
+func (d *Datum) signingBuffer() []byte {
+	tbs := fmt.Sprintf("3:seqi%de1:v", d.SequenceNo) + string(d.Value)
+	if len(d.Salt) > 0 {
+		tbs = fmt.Sprintf("4:salt%d:", len(d.Salt)) + string(d.Salt) + tbs
+	}
+
+	return []byte(tbs)
+}
+
+// Returns true iff the datum's signature is valid. Only meaningful for mutable
+// data.
+func (d *Datum) verifySignature() bool {
+	if !d.Key.IsWellFormed() || !d.Signature.IsWellFormed() {
+		return false
+	}
+
+	return ed25519.Verify(ed25519.PublicKey(d.Key), d.signingBuffer(), []byte(d.Signature))
+}
+
+// Returns true iff the datum is a valid datum for the given target. For
+// mutable data, this includes checking the signature.
+func (d *Datum) verify(target InfoHash) bool {
+	if d.target() != target {
+		return false
+	}
+
+	return !d.IsMutable() || d.verifySignature()
+}
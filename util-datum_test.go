@@ -0,0 +1,148 @@
+package dht
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+)
+
+func mustDecodeHex(s string) string {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
+
+// Test vectors from BEP 44.
+var (
+	bep44PublicKey = krPublicKey(mustDecodeHex("77ff84905a91936367c01360803104f92432fcd904a43511876df5cdf3e7e548"))
+
+	bep44Mutable = Datum{
+		Value:      []byte("12:Hello World!"),
+		Key:        bep44PublicKey,
+		Signature:  krSignature(mustDecodeHex("305ac8aeb6c9c151fa120f120ea2cfb923564e11552d06a5d856091e5e853cff1260d3f39e4999684aa92eb73ffd136e6f4f3ecbfda0ce53a1608ecd7ae21f01")),
+		SequenceNo: 1,
+	}
+	bep44MutableTarget = MustParseInfoHash("4a533d47ec9c7d95b1ad75f576cffc641853b750")
+
+	bep44MutableSalted = Datum{
+		Value:      []byte("12:Hello World!"),
+		Key:        bep44PublicKey,
+		Salt:       []byte("foobar"),
+		Signature:  krSignature(mustDecodeHex("6834284b6b24c3204eb2fea824d82f88883a3d95e8b4a21b8c0ded553d17d17ddf9a8a7104b1258f30bed3787e6cb896fca78c58f8e03b5f18f14951a87d9a08")),
+		SequenceNo: 1,
+	}
+	bep44MutableSaltedTarget = MustParseInfoHash("411eba73b6f087ca51a3795d9c8c938d365e32c1")
+
+	bep44Immutable       = Datum{Value: []byte("12:Hello World!")}
+	bep44ImmutableTarget = MustParseInfoHash("e5f96f6f38320f0f33959cb4d3d656452117aadb")
+)
+
+func TestDatumVerify(t *testing.T) {
+	var tests = []struct {
+		Datum  Datum
+		Target InfoHash
+	}{
+		{bep44Mutable, bep44MutableTarget},
+		{bep44MutableSalted, bep44MutableSaltedTarget},
+		{bep44Immutable, bep44ImmutableTarget},
+	}
+
+	for _, tst := range tests {
+		d := tst.Datum
+		if d.target() != tst.Target {
+			t.Fatalf("wrong target: %v", d.target())
+		}
+
+		if !d.verify(tst.Target) {
+			t.Fatalf("datum should verify")
+		}
+
+		d.Value = []byte("12:Hello World?")
+		if d.verify(tst.Target) {
+			t.Fatalf("forged value should not verify")
+		}
+	}
+
+	d := bep44Mutable
+	d.SequenceNo = 2
+	if d.verify(bep44MutableTarget) {
+		t.Fatalf("forged sequence number should not verify")
+	}
+
+	d = bep44MutableSalted
+	d.Salt = []byte("foobaz")
+	if d.verifySignature() {
+		t.Fatalf("wrong salt should not verify")
+	}
+}
+
+func TestDatumSigningBuffer(t *testing.T) {
+	if string(bep44Mutable.signingBuffer()) != "3:seqi1e1:v12:Hello World!" {
+		t.Fatalf("wrong signing buffer: %q", bep44Mutable.signingBuffer())
+	}
+
+	if string(bep44MutableSalted.signingBuffer()) != "4:salt6:foobar3:seqi1e1:v12:Hello World!" {
+		t.Fatalf("wrong signing buffer: %q", bep44MutableSalted.signingBuffer())
+	}
+}
+
+func TestDatumTargets(t *testing.T) {
+	if ImmutableTarget([]byte("12:Hello World!")) != bep44ImmutableTarget {
+		t.Fatal()
+	}
+
+	if MutableTarget([]byte(bep44PublicKey), nil) != bep44MutableTarget {
+		t.Fatal()
+	}
+
+	if MutableTarget([]byte(bep44PublicKey), []byte("foobar")) != bep44MutableSaltedTarget {
+		t.Fatal()
+	}
+}
+
+func TestNewMutableDatum(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal()
+	}
+
+	d, err := NewMutableDatum(privateKey, []byte("12:Hello World!"), []byte("foobar"), 42)
+	if err != nil {
+		t.Fatalf("cannot sign: %v", err)
+	}
+
+	if !d.IsMutable() || d.SequenceNo != 42 {
+		t.Fatal()
+	}
+
+	target := MutableTarget(publicKey, []byte("foobar"))
+	if !d.verify(target) {
+		t.Fatalf("signed datum should verify")
+	}
+
+	_, err = NewMutableDatum(privateKey, []byte("1:x"), make([]byte, maxSaltLen+1), 1)
+	if err == nil {
+		t.Fatalf("oversized salt should be rejected")
+	}
+}
+
+func TestNewImmutableDatum(t *testing.T) {
+	d, err := NewImmutableDatum([]byte("d1:ai1e1:bl1:x1:yee"))
+	if err != nil {
+		t.Fatalf("cannot create datum: %v", err)
+	}
+
+	if d.IsMutable() || d.target() != ImmutableTarget(d.Value) {
+		t.Fatal()
+	}
+
+	for _, v := range []string{"", "Hello World!", "12:Hello World", "i1ei2e"} {
+		_, err = NewImmutableDatum([]byte(v))
+		if err == nil {
+			t.Fatalf("invalid value should be rejected: %q", v)
+		}
+	}
+}
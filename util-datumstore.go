@@ -0,0 +1,168 @@
+package dht
+
+import (
+	"container/list"
+	"errors"
+	"net"
+	"time"
+)
+
+// Returned by datumStore.Put when the source of a put has exceeded its quota.
+var errDatumQuotaExceeded = errors.New("storage quota exceeded")
+
+// A datum held by a datumStore.
+type storedDatum struct {
+	target InfoHash
+	datum  *Datum
+	expiry time.Time
+	size   int
+
+	// Quota keys of the node which first stored the datum.
+	ipKey, netKey string
+
+	// Element in datumStore.order.
+	elem *list.Element
+}
+
+// Stores BEP 44 data put by other nodes. Data expire after a fixed lifetime
+// unless put again, the total size of stored data is capped, and the number of
+// data stored on behalf of any one IP address or subnet is limited.
+type datumStore struct {
+	data map[InfoHash]*storedDatum
+
+	// Stored data ordered by expiry time, soonest first.
+	order *list.List
+
+	// Number of data stored on behalf of each IP and subnet.
+	ipCounts, netCounts map[string]int
+
+	totalSize int
+
+	lifetime     time.Duration
+	maxSize      int
+	maxPerIP     int
+	maxPerSubnet int
+}
+
+func newDatumStore(lifetime time.Duration, maxSize, maxPerIP, maxPerSubnet int) *datumStore {
+	return &datumStore{
+		data:         map[InfoHash]*storedDatum{},
+		order:        list.New(),
+		ipCounts:     map[string]int{},
+		netCounts:    map[string]int{},
+		lifetime:     lifetime,
+		maxSize:      maxSize,
+		maxPerIP:     maxPerIP,
+		maxPerSubnet: maxPerSubnet,
+	}
+}
+
+// Returns the quota keys for an IP address. Subnets are /24 for IPv4 and /64
+// for IPv6.
+func datumQuotaKeys(ip net.IP) (ipKey, netKey string) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return string(ip4), string(ip4.Mask(net.CIDRMask(24, 32)))
+	}
+
+	ip = ip.To16()
+	return string(ip), string(ip.Mask(net.CIDRMask(64, 128)))
+}
+
+func datumSize(datum *Datum) int {
+	return len(datum.Value) + len(datum.Key) + len(datum.Salt) + len(datum.Signature)
+}
+
+// Returns the datum stored for the target, or nil if there is none or it has
+// expired.
+func (ds *datumStore) Get(target InfoHash, now time.Time) *Datum {
+	sd, ok := ds.data[target]
+	if !ok || !now.Before(sd.expiry) {
+		return nil
+	}
+
+	return sd.datum
+}
+
+// Store a datum put by a node at the given IP, replacing any datum already
+// stored for the target and resetting its expiry. Puts of new targets count
+// against the quotas of the putting node's IP and subnet; puts which refresh
+// or update a stored target do not. Older data are evicted as necessary to
+// keep within the size cap.
+func (ds *datumStore) Put(target InfoHash, datum *Datum, ip net.IP, now time.Time) error {
+	ds.Expire(now)
+
+	size := datumSize(datum)
+	if size > ds.maxSize {
+		return errDatumQuotaExceeded
+	}
+
+	sd, ok := ds.data[target]
+	if ok {
+		ds.totalSize -= sd.size
+		ds.order.Remove(sd.elem)
+	} else {
+		ipKey, netKey := datumQuotaKeys(ip)
+		if ds.ipCounts[ipKey] >= ds.maxPerIP || ds.netCounts[netKey] >= ds.maxPerSubnet {
+			return errDatumQuotaExceeded
+		}
+
+		sd = &storedDatum{
+			target: target,
+			ipKey:  ipKey,
+			netKey: netKey,
+		}
+		ds.data[target] = sd
+		ds.ipCounts[ipKey]++
+		ds.netCounts[netKey]++
+	}
+
+	sd.datum = datum
+	sd.size = size
+	sd.expiry = now.Add(ds.lifetime)
+	sd.elem = ds.order.PushBack(sd)
+	ds.totalSize += size
+
+	for ds.totalSize > ds.maxSize {
+		ds.remove(ds.order.Front().Value.(*storedDatum))
+	}
+
+	return nil
+}
+
+// Remove expired data. Called periodically.
+func (ds *datumStore) Expire(now time.Time) {
+	for e := ds.order.Front(); e != nil; e = ds.order.Front() {
+		sd := e.Value.(*storedDatum)
+		if now.Before(sd.expiry) {
+			break
+		}
+
+		ds.remove(sd)
+	}
+}
+
+func (ds *datumStore) remove(sd *storedDatum) {
+	ds.order.Remove(sd.elem)
+	delete(ds.data, sd.target)
+	ds.totalSize -= sd.size
+
+	ds.ipCounts[sd.ipKey]--
+	if ds.ipCounts[sd.ipKey] == 0 {
+		delete(ds.ipCounts, sd.ipKey)
+	}
+
+	ds.netCounts[sd.netKey]--
+	if ds.netCounts[sd.netKey] == 0 {
+		delete(ds.netCounts, sd.netKey)
+	}
+}
+
+// Returns the number of data stored.
+func (ds *datumStore) Len() int {
+	return len(ds.data)
+}
+
+// Returns the total size of the data stored, in bytes.
+func (ds *datumStore) Size() int {
+	return ds.totalSize
+}
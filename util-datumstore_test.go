@@ -0,0 +1,75 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDatumStore(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	ds := newDatumStore(2*time.Hour, 40, 2, 3)
+
+	d1 := &Datum{Value: []byte("1:a")}
+	d2 := &Datum{Value: []byte("1:b")}
+	d3 := &Datum{Value: []byte("1:c")}
+	d4 := &Datum{Value: []byte("1:d")}
+
+	ipA := net.ParseIP("1.2.3.4")
+	ipB := net.ParseIP("1.2.3.5")
+	ipC := net.ParseIP("5.6.7.8")
+
+	if ds.Put(d1.target(), d1, ipA, now) != nil || ds.Put(d2.target(), d2, ipA, now) != nil {
+		t.Fatal()
+	}
+
+	// Per-IP quota.
+	if ds.Put(d3.target(), d3, ipA, now) != errDatumQuotaExceeded {
+		t.Fatal()
+	}
+
+	// Per-subnet quota.
+	if ds.Put(d3.target(), d3, ipB, now) != nil {
+		t.Fatal()
+	}
+	if ds.Put(d4.target(), d4, ipB, now) != errDatumQuotaExceeded {
+		t.Fatal()
+	}
+
+	// Refreshing an existing datum does not count against the quota.
+	if ds.Put(d1.target(), d1, ipA, now.Add(1*time.Hour)) != nil {
+		t.Fatal()
+	}
+
+	if ds.Len() != 3 || ds.Size() != 9 || ds.Get(d2.target(), now) != d2 {
+		t.Fatal()
+	}
+
+	// Expiry.
+	later := now.Add(2 * time.Hour)
+	if ds.Get(d2.target(), later) != nil || ds.Get(d1.target(), later) != d1 {
+		t.Fatal()
+	}
+
+	ds.Expire(later)
+	if ds.Len() != 1 || ds.Size() != 3 {
+		t.Fatal()
+	}
+
+	// Expired data no longer count against the quota.
+	if ds.Put(d4.target(), d4, ipB, later) != nil {
+		t.Fatal()
+	}
+
+	// Size cap. The soonest-expiring data are evicted first.
+	big := &Datum{Value: []byte("32:01234567890123456789012345678901")}
+	if ds.Put(big.target(), big, ipC, later) != nil {
+		t.Fatal()
+	}
+	if ds.Get(d1.target(), later) != nil || ds.Get(d4.target(), later) != d4 || ds.Get(big.target(), later) != big {
+		t.Fatal()
+	}
+	if ds.Size() != 38 {
+		t.Fatal()
+	}
+}
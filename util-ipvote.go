@@ -0,0 +1,71 @@
+package dht
+
+import (
+	"github.com/golang/groupcache/lru"
+	"net"
+)
+
+// Tallies the external IP address reported for this node by other nodes. Each
+// reporting IP has one vote, for the address it reported most recently.
+type ipVote struct {
+	// Maps each reporter IP to the IP it reported. The least recently heard
+	// reporters are discarded when there are too many.
+	reports *lru.Cache
+
+	// Number of reporters currently reporting each IP.
+	counts map[string]int
+
+	minVotes int
+}
+
+func newIPVote(maxReporters, minVotes int) *ipVote {
+	v := &ipVote{
+		reports:  lru.New(maxReporters),
+		counts:   map[string]int{},
+		minVotes: minVotes,
+	}
+	v.reports.OnEvicted = func(key lru.Key, value interface{}) {
+		v.remove(value.(string))
+	}
+	return v
+}
+
+func (v *ipVote) remove(ip string) {
+	v.counts[ip]--
+	if v.counts[ip] <= 0 {
+		delete(v.counts, ip)
+	}
+}
+
+// Record that a node at the reporter IP has reported that this node's IP is
+// the given IP.
+func (v *ipVote) Add(reporter, ip net.IP) {
+	key, value := reporter.String(), ip.String()
+
+	if old, ok := v.reports.Get(key); ok {
+		if old.(string) == value {
+			return
+		}
+		v.remove(old.(string))
+	}
+
+	v.reports.Add(key, value)
+	v.counts[value]++
+}
+
+// Returns the IP reported by an absolute majority of reporters, if it has at
+// least the minimum number of votes. Otherwise returns nil.
+func (v *ipVote) Result() net.IP {
+	total := 0
+	for _, c := range v.counts {
+		total += c
+	}
+
+	for ip, c := range v.counts {
+		if c >= v.minVotes && c*2 > total {
+			return net.ParseIP(ip)
+		}
+	}
+
+	return nil
+}
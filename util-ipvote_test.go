@@ -0,0 +1,45 @@
+package dht
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIPVote(t *testing.T) {
+	v := newIPVote(4, 2)
+
+	a, b := net.ParseIP("1.2.3.4"), net.ParseIP("5.6.7.8")
+	r1, r2, r3, r4, r5 := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.3"), net.ParseIP("10.0.0.4"), net.ParseIP("10.0.0.5")
+
+	v.Add(r1, a)
+	v.Add(r1, a)
+	if v.Result() != nil {
+		t.Fatal("one reporter should not be enough")
+	}
+
+	v.Add(r2, a)
+	if !v.Result().Equal(a) {
+		t.Fatal()
+	}
+
+	// No absolute majority.
+	v.Add(r3, b)
+	v.Add(r4, b)
+	if v.Result() != nil {
+		t.Fatal()
+	}
+
+	// A reporter changing its vote replaces its old vote.
+	v.Add(r1, b)
+	if !v.Result().Equal(b) {
+		t.Fatal()
+	}
+
+	// The least recently heard reporter is discarded.
+	v.Add(r5, a)
+	v.Add(r3, a)
+	v.Add(r4, a)
+	if !v.Result().Equal(a) || v.counts[b.String()] != 1 {
+		t.Fatalf("%v", v.counts)
+	}
+}
@@ -0,0 +1,224 @@
+package dht
+
+import (
+	"github.com/hlandau/goutils/clock"
+	"sort"
+)
+
+// DHT routing using k-buckets, as described in BEP 5.
+//
+// Bucket i holds nodes whose IDs share exactly i leading bits with our own ID,
+// except for the last bucket, which holds all nodes sharing at least that many
+// bits and therefore covers our own ID. Initially there is a single bucket
+// covering the whole keyspace.
+//
+// Each bucket holds at most kNodes nodes. When the last bucket is full it is
+// split in two. When any other bucket is full, a new node may only displace a
+// bad node; otherwise it is kept in the bucket's replacement cache, from which
+// nodes are promoted as bucket entries are removed. Nodes which have never
+// responded to us, such as those learned of from other nodes, are also kept in
+// the replacement cache until they respond. Thus distant regions of the
+// keyspace cannot crowd out our neighbourhood, and long-lived good nodes are
+// never displaced by newcomers.
+type bucketTable struct {
+	nodeID  NodeID
+	buckets []*kBucket
+	clock   clock.Clock
+}
+
+// Maximum number of nodes in each bucket's replacement cache.
+const bucketReplacements = kNodes
+
+type kBucket struct {
+	nodes        []*node
+	replacements []*node // Least recently added first.
+}
+
+func newBucketTable(nodeID NodeID, clock clock.Clock) *bucketTable {
+	return &bucketTable{
+		nodeID:  nodeID,
+		buckets: []*kBucket{{}},
+		clock:   clock,
+	}
+}
+
+func (bt *bucketTable) bucketIndex(nodeID NodeID) int {
+	i := commonBits([]byte(bt.nodeID), []byte(nodeID))
+	if i >= len(bt.buckets) {
+		i = len(bt.buckets) - 1
+	}
+
+	return i
+}
+
+func (bt *bucketTable) Insert(n *node) {
+	i := bt.bucketIndex(n.NodeID)
+	b := bt.buckets[i]
+
+	now := bt.clock.Now()
+	for j, m := range b.nodes {
+		if m.NodeID != n.NodeID {
+			continue
+		}
+
+		// A node claiming the ID of a good entry at another address does not
+		// displace it.
+		if m != n && m.Addr.String() != n.Addr.String() && m.State(now) != nodeBad {
+			b.addReplacement(n)
+			return
+		}
+
+		b.nodes[j] = n
+		b.replacements = removeNode(b.replacements, n)
+		return
+	}
+
+	if !n.IsReachable() {
+		// Unverified.
+		b.addReplacement(n)
+		return
+	}
+
+	b.replacements = removeNode(b.replacements, n)
+
+	for len(b.nodes) >= kNodes && i == len(bt.buckets)-1 && i < NodeIDBits {
+		bt.split()
+		i = bt.bucketIndex(n.NodeID)
+		b = bt.buckets[i]
+	}
+
+	if len(b.nodes) < kNodes {
+		b.nodes = append(b.nodes, n)
+		return
+	}
+
+	for j, m := range b.nodes {
+		if m.State(now) == nodeBad {
+			b.nodes[j] = n
+			b.addReplacement(m)
+			return
+		}
+	}
+
+	b.addReplacement(n)
+}
+
+// Split the last bucket in two.
+func (bt *bucketTable) split() {
+	last := bt.buckets[len(bt.buckets)-1]
+	bt.buckets = append(bt.buckets, &kBucket{})
+
+	nodes, replacements := last.nodes, last.replacements
+	last.nodes, last.replacements = nil, nil
+
+	for _, n := range nodes {
+		b := bt.buckets[bt.bucketIndex(n.NodeID)]
+		b.nodes = append(b.nodes, n)
+	}
+
+	for _, n := range replacements {
+		bt.buckets[bt.bucketIndex(n.NodeID)].addReplacement(n)
+	}
+}
+
+func (b *kBucket) addReplacement(n *node) {
+	b.replacements = append(removeNode(b.replacements, n), n)
+	if len(b.replacements) > bucketReplacements {
+		b.replacements = b.replacements[1:]
+	}
+}
+
+func (bt *bucketTable) Remove(n *node) {
+	b := bt.buckets[bt.bucketIndex(n.NodeID)]
+	b.replacements = removeNode(b.replacements, n)
+
+	numNodes := len(b.nodes)
+	b.nodes = removeNode(b.nodes, n)
+	if len(b.nodes) == numNodes {
+		return
+	}
+
+	// Promote the most recently added replacement which has responded and is
+	// not bad.
+	now := bt.clock.Now()
+	for j := len(b.replacements) - 1; j >= 0; j-- {
+		r := b.replacements[j]
+		if r.IsReachable() && r.State(now) != nodeBad {
+			b.replacements = removeNode(b.replacements, r)
+			b.nodes = append(b.nodes, r)
+			return
+		}
+	}
+}
+
+// Change our own ID. The buckets are rebuilt around the new ID.
+func (bt *bucketTable) SetNodeID(nodeID NodeID) {
+	old := bt.buckets
+	bt.nodeID = nodeID
+	bt.buckets = []*kBucket{{}}
+
+	for _, b := range old {
+		for _, n := range b.nodes {
+			bt.Insert(n)
+		}
+	}
+
+	for _, b := range old {
+		for _, n := range b.replacements {
+			bt.Insert(n)
+		}
+	}
+}
+
+// Find the nodes nearest to the given infohash.
+func (bt *bucketTable) Lookup(infoHash InfoHash) []*node {
+	return bt.LookupFiltered(infoHash, alwaysYes)
+}
+
+// Find the nodes nearest to the given infohash, filtered by filterFunc. Bad
+// nodes are never returned.
+func (bt *bucketTable) LookupFiltered(infoHash InfoHash, filterFunc func(infoHash InfoHash, n *node) bool) []*node {
+	if infoHash == "" {
+		return nil
+	}
+
+	var r []*node
+	now := bt.clock.Now()
+	for _, b := range bt.buckets {
+		for _, n := range b.nodes {
+			if n.State(now) != nodeBad && filterFunc(infoHash, n) {
+				r = append(r, n)
+			}
+		}
+	}
+
+	sort.Slice(r, func(i, j int) bool {
+		return hashDistance(infoHash, InfoHash(r[i].NodeID)) < hashDistance(infoHash, InfoHash(r[j].NodeID))
+	})
+
+	if len(r) > kNodes {
+		r = r[:kNodes]
+	}
+
+	return r
+}
+
+// Returns the number of nodes in the buckets, not including replacements.
+func (bt *bucketTable) Len() int {
+	num := 0
+	for _, b := range bt.buckets {
+		num += len(b.nodes)
+	}
+
+	return num
+}
+
+func removeNode(nodes []*node, n *node) []*node {
+	for i, m := range nodes {
+		if m == n {
+			return append(nodes[:i], nodes[i+1:]...)
+		}
+	}
+
+	return nodes
+}
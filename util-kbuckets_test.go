@@ -0,0 +1,113 @@
+package dht
+
+import (
+	"github.com/hlandau/goutils/clock"
+	"testing"
+	"time"
+)
+
+func bucketTestNode(b0, b19 byte) *node {
+	id := make([]byte, 20)
+	id[0] = b0
+	id[19] = b19
+	n := newNode(*mustResolve("1.2.3.4:5555"), NodeID(id))
+	n.LastRxTime = time.Now()
+	return n
+}
+
+func TestBucketTable(t *testing.T) {
+	bt := newBucketTable(NodeID(make([]byte, 20)), clock.Real)
+
+	// Fill the bucket for the far half of the keyspace.
+	var far []*node
+	for i := 0; i < kNodes; i++ {
+		n := bucketTestNode(0x80, byte(i))
+		far = append(far, n)
+		bt.Insert(n)
+	}
+
+	// Once the bucket no longer covers our own ID, further distant nodes go to
+	// the replacement cache.
+	extra := bucketTestNode(0x80, 0xFF)
+	bt.Insert(extra)
+	if bt.Len() != kNodes || len(bt.buckets[0].replacements) != 1 {
+		t.Fatalf("%d %d", bt.Len(), len(bt.buckets[0].replacements))
+	}
+
+	// The bucket covering our own ID is split whenever it fills, so nearby
+	// nodes are always kept.
+	var near []*node
+	for i := 0; i < kNodes; i++ {
+		n := bucketTestNode(0x01, byte(i))
+		near = append(near, n)
+		bt.Insert(n)
+	}
+	bt.Insert(bucketTestNode(0x02, 0))
+	if bt.Len() != 2*kNodes+1 || len(bt.buckets) != 8 {
+		t.Fatalf("%d %d", bt.Len(), len(bt.buckets))
+	}
+
+	ns := bt.Lookup(InfoHash(make([]byte, 20)))
+	if len(ns) != kNodes {
+		t.Fatal()
+	}
+	for i, n := range ns {
+		if n != near[i] {
+			t.Fatalf("%d", i)
+		}
+	}
+
+	// A bad node is displaced by a new node.
+	far[3].NumFailures = nodeBadFailures
+	n := bucketTestNode(0x80, 0xFE)
+	bt.Insert(n)
+	if bt.buckets[0].nodes[3] != n {
+		t.Fatal()
+	}
+
+	// Removing a node promotes the most recent replacement which is not bad.
+	bt.Remove(far[0])
+	if bt.Len() != 2*kNodes+1 || bt.buckets[0].nodes[kNodes-1] != extra {
+		t.Fatal()
+	}
+
+	// Bad nodes are never returned.
+	far[1].NumFailures = nodeBadFailures
+	for _, n := range bt.Lookup(InfoHash(far[1].NodeID)) {
+		if n == far[1] {
+			t.Fatal()
+		}
+	}
+
+	// Changing our ID keeps the nodes.
+	bt.SetNodeID(far[2].NodeID)
+	if bt.Len() != 2*kNodes+1 {
+		t.Fatalf("%d", bt.Len())
+	}
+	if ns := bt.Lookup(InfoHash(far[2].NodeID)); len(ns) != kNodes || ns[0] != far[2] {
+		t.Fatal()
+	}
+
+	// A node claiming the ID of a good node at another address does not
+	// displace it.
+	impostor := newNode(*mustResolve("1.2.3.5:5555"), far[2].NodeID)
+	impostor.LastRxTime = time.Now()
+	bt.Insert(impostor)
+	if ns := bt.Lookup(InfoHash(far[2].NodeID)); ns[0] != far[2] {
+		t.Fatal()
+	}
+
+	// A node which has never responded is not returned until it has.
+	unverified := bucketTestNode(0x80, 0x12)
+	unverified.LastRxTime = time.Time{}
+	bt.Insert(unverified)
+	if ns := bt.Lookup(InfoHash(unverified.NodeID)); ns[0] == unverified {
+		t.Fatal()
+	}
+
+	unverified.LastRxTime = time.Now()
+	bt.Insert(unverified)
+	if ns := bt.Lookup(InfoHash(unverified.NodeID)); ns[0] != unverified {
+		t.Fatal()
+	}
+}
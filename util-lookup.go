@@ -0,0 +1,236 @@
+package dht
+
+import (
+	"sort"
+	"time"
+)
+
+// An iterative lookup towards a target, as described in BEP 5 and the
+// Kademlia paper.
+//
+// The lookup maintains a shortlist of candidate nodes sorted by XOR distance
+// to the target. Up to α of the closest unqueried candidates are queried at
+// once, those with the lowest RTT first among candidates sharing as many
+// leading bits with the target; their responses add closer candidates to the
+// shortlist. The lookup has
+// converged once the kNodes closest candidates which have not failed have all
+// responded.
+type lookup struct {
+	method    string // "find_node", "get_peers" or "get".
+	target    InfoHash
+	startTime time.Time
+
+	// Sorted by distance to the target.
+	candidates []*lookupCandidate
+
+	// Statistics. Hops is the greatest depth of any candidate which responded.
+	numQueried, numResponded, hops int
+}
+
+// Maximum number of candidates kept in a lookup's shortlist.
+const lookupShortlistLen = 4 * kNodes
+
+type lookupCandidateState int
+
+const (
+	lookupCandidateNew lookupCandidateState = iota
+	lookupCandidateQueried
+	lookupCandidateResponded
+	lookupCandidateFailed
+)
+
+type lookupCandidate struct {
+	n     *node
+	state lookupCandidateState
+
+	// The number of hops from our routing table to the candidate. Candidates
+	// taken from the routing table are one hop away.
+	depth int
+
+	// The write token issued by the candidate in its response, if any.
+	token []byte
+}
+
+func newLookup(method string, target InfoHash, startTime time.Time) *lookup {
+	return &lookup{
+		method:    method,
+		target:    target,
+		startTime: startTime,
+	}
+}
+
+func (l *lookup) distance(n *node) string {
+	return hashDistance(l.target, InfoHash(n.NodeID))
+}
+
+// Add a candidate node at the given depth. Returns false if the node is
+// already a candidate or is too distant to be kept.
+//
+// When the shortlist is full, the most distant candidate which is new or has
+// failed is evicted to make room. Candidates which have been queried are kept,
+// so that their responses are not lost.
+func (l *lookup) add(n *node, depth int) bool {
+	if !n.NodeID.Valid() || l.find(n) != nil {
+		return false
+	}
+
+	dist := l.distance(n)
+	i := sort.Search(len(l.candidates), func(i int) bool {
+		return l.distance(l.candidates[i].n) > dist
+	})
+
+	if len(l.candidates) >= lookupShortlistLen {
+		j := len(l.candidates) - 1
+		for j >= i && !l.candidates[j].isEvictable() {
+			j--
+		}
+		if j < i {
+			return false
+		}
+
+		l.candidates = append(l.candidates[:j], l.candidates[j+1:]...)
+	}
+
+	l.candidates = append(l.candidates, nil)
+	copy(l.candidates[i+1:], l.candidates[i:])
+	l.candidates[i] = &lookupCandidate{n: n, depth: depth}
+
+	return true
+}
+
+// Returns true iff the candidate may be dropped from the shortlist.
+func (c *lookupCandidate) isEvictable() bool {
+	return c.state == lookupCandidateNew || c.state == lookupCandidateFailed
+}
+
+// Returns the candidate for the given node, which is matched by address or
+// node ID, or nil.
+func (l *lookup) find(n *node) *lookupCandidate {
+	addr := n.Addr.String()
+	for _, c := range l.candidates {
+		if c.n == n || c.n.NodeID == n.NodeID || c.n.Addr.String() == addr {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// Iterates over the kNodes closest candidates which have not failed.
+func (l *lookup) forClosest(f func(c *lookupCandidate)) {
+	num := 0
+	for _, c := range l.candidates {
+		if num >= kNodes {
+			break
+		}
+
+		if c.state != lookupCandidateFailed {
+			f(c)
+			num++
+		}
+	}
+}
+
+// Returns the candidates which should be queried next so that up to alpha
+// queries are in flight, and marks them as queried.
+func (l *lookup) next(alpha int) []*lookupCandidate {
+	var fresh []*lookupCandidate
+	l.forClosest(func(c *lookupCandidate) {
+		if c.state == lookupCandidateNew {
+			fresh = append(fresh, c)
+		}
+	})
+
+	// Candidates which are equally close, by the number of leading bits they
+	// share with the target, are queried fastest first. Nodes whose RTT is
+	// unknown are assumed to be slow.
+	sort.SliceStable(fresh, func(i, j int) bool {
+		bi, bj := l.prefixLen(fresh[i].n), l.prefixLen(fresh[j].n)
+		if bi != bj {
+			return bi > bj
+		}
+		return fresh[i].n.RTO() < fresh[j].n.RTO()
+	})
+
+	var r []*lookupCandidate
+	numInFlight := l.numInState(lookupCandidateQueried)
+	for _, c := range fresh {
+		if numInFlight >= alpha {
+			break
+		}
+
+		c.state = lookupCandidateQueried
+		r = append(r, c)
+		numInFlight++
+		l.numQueried++
+	}
+
+	return r
+}
+
+// Returns the number of leading bits the node's ID shares with the target.
+func (l *lookup) prefixLen(n *node) int {
+	return commonBits([]byte(l.target), []byte(n.NodeID))
+}
+
+// Record a response from a queried node. Returns the candidate, or nil if the
+// node was not queried by this lookup.
+func (l *lookup) responded(n *node) *lookupCandidate {
+	c := l.find(n)
+	if c == nil || c.state != lookupCandidateQueried {
+		return nil
+	}
+
+	c.state = lookupCandidateResponded
+	l.numResponded++
+	if c.depth > l.hops {
+		l.hops = c.depth
+	}
+
+	return c
+}
+
+// Record that a query to a node failed.
+func (l *lookup) failed(n *node) {
+	c := l.find(n)
+	if c != nil && c.state == lookupCandidateQueried {
+		c.state = lookupCandidateFailed
+	}
+}
+
+// Returns true once the kNodes closest candidates which have not failed have
+// all responded, or there is nobody left to ask.
+func (l *lookup) converged() bool {
+	converged := true
+	l.forClosest(func(c *lookupCandidate) {
+		if c.state != lookupCandidateResponded {
+			converged = false
+		}
+	})
+
+	return converged
+}
+
+func (l *lookup) numInState(state lookupCandidateState) int {
+	num := 0
+	for _, c := range l.candidates {
+		if c.state == state {
+			num++
+		}
+	}
+
+	return num
+}
+
+// Returns the candidates which responded with a write token, sorted by
+// distance to the target.
+func (l *lookup) responders() []tokenResponder {
+	var r []tokenResponder
+	for _, c := range l.candidates {
+		if c.state == lookupCandidateResponded && len(c.token) > 0 {
+			r = append(r, tokenResponder{n: c.n, token: c.token})
+		}
+	}
+
+	return r
+}
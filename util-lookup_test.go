@@ -0,0 +1,149 @@
+package dht
+
+import (
+	"testing"
+	"time"
+)
+
+func lookupTestNode(b0 byte, port int) *node {
+	id := make([]byte, 20)
+	id[0] = b0
+	addr := *mustResolve("1.2.3.4:5555")
+	addr.Port = port
+	return newNode(addr, NodeID(id))
+}
+
+func TestLookup(t *testing.T) {
+	l := newLookup("find_node", InfoHash(make([]byte, 20)), time.Now())
+
+	// Seeds from the routing table, furthest first.
+	for i := 0; i < 4; i++ {
+		l.add(lookupTestNode(byte(0x80+i), 1000+i), 1)
+	}
+	if l.add(lookupTestNode(0x80, 2000), 1) || l.add(lookupTestNode(0x90, 1000), 1) {
+		t.Fatal("duplicate added")
+	}
+
+	// The closest candidates are queried first, no more than alpha at once.
+	q := l.next(3)
+	if len(q) != 3 || q[0].n.NodeID[0] != 0x80 || q[2].n.NodeID[0] != 0x82 {
+		t.Fatal()
+	}
+	if len(l.next(3)) != 0 || l.converged() {
+		t.Fatal()
+	}
+
+	// A response brings closer nodes, which are queried in preference to the
+	// remaining seed.
+	if l.responded(q[0].n) == nil || l.responded(q[0].n) != nil {
+		t.Fatal()
+	}
+	for i := 0; i < 2; i++ {
+		l.add(lookupTestNode(byte(0x10+i), 3000+i), 2)
+	}
+	l.failed(q[1].n)
+	q2 := l.next(3)
+	if len(q2) != 2 || q2[0].n.NodeID[0] != 0x10 || q2[1].n.NodeID[0] != 0x11 {
+		t.Fatalf("%d", len(q2))
+	}
+
+	// With fewer than kNodes candidates, all must respond before the lookup
+	// converges.
+	l.responded(q[2].n)
+	l.responded(q2[0].n)
+	l.responded(q2[1].n)
+	if l.converged() {
+		t.Fatal()
+	}
+
+	q3 := l.next(3)
+	if len(q3) != 1 || q3[0].n.NodeID[0] != 0x83 {
+		t.Fatal()
+	}
+	l.responded(q3[0].n)
+	if !l.converged() {
+		t.Fatal()
+	}
+
+	if l.numQueried != 6 || l.numResponded != 5 || l.hops != 2 {
+		t.Fatalf("%d %d %d", l.numQueried, l.numResponded, l.hops)
+	}
+}
+
+func TestLookupConverged(t *testing.T) {
+	l := newLookup("get", InfoHash(make([]byte, 20)), time.Now())
+	for i := 0; i < 2*kNodes; i++ {
+		l.add(lookupTestNode(byte(i+1), 1000+i), 1)
+	}
+
+	// Once the kNodes closest have responded, more distant candidates are not
+	// needed.
+	for len(l.next(kNodes)) > 0 {
+		for _, c := range l.candidates {
+			if c.state == lookupCandidateQueried {
+				l.responded(c.n)
+			}
+		}
+	}
+
+	if !l.converged() || l.numQueried != kNodes {
+		t.Fatalf("%d", l.numQueried)
+	}
+}
+
+func TestLookupShortlist(t *testing.T) {
+	l := newLookup("get_peers", InfoHash(make([]byte, 20)), time.Now())
+	for i := 0; i < lookupShortlistLen; i++ {
+		l.add(lookupTestNode(byte(0x40+i), 1000+i), 1)
+	}
+
+	// Mark the most distant candidates as queried, as if closer candidates had
+	// failed.
+	for _, c := range l.candidates[lookupShortlistLen-3:] {
+		c.state = lookupCandidateQueried
+	}
+	far := l.candidates[lookupShortlistLen-4]
+
+	// Closer nodes displace the most distant candidates which have not been
+	// queried, and more distant ones are not kept.
+	if !l.add(lookupTestNode(0x10, 2000), 2) || l.add(lookupTestNode(0xf0, 2001), 2) {
+		t.Fatal()
+	}
+	if len(l.candidates) != lookupShortlistLen || l.find(far.n) != nil {
+		t.Fatalf("%d", len(l.candidates))
+	}
+	if l.numInState(lookupCandidateQueried) != 3 {
+		t.Fatal("queried candidate evicted")
+	}
+
+	// Queried candidates are never evicted.
+	for _, c := range l.candidates {
+		c.state = lookupCandidateQueried
+	}
+	if l.add(lookupTestNode(0x01, 2002), 2) {
+		t.Fatal()
+	}
+	for _, c := range l.candidates[lookupShortlistLen-3:] {
+		if l.responded(c.n) == nil {
+			t.Fatal("response lost")
+		}
+	}
+}
+
+func TestLookupRTT(t *testing.T) {
+	l := newLookup("find_node", InfoHash(make([]byte, 20)), time.Now())
+	slow := lookupTestNode(0x80, 1000)
+	fast := lookupTestNode(0x81, 1001)
+	fast.AddRTTSample(10 * time.Millisecond)
+	near := lookupTestNode(0x40, 1002)
+	l.add(slow, 1)
+	l.add(fast, 1)
+	l.add(near, 1)
+
+	// Closer candidates by shared prefix come first; among those equally
+	// close, the fastest.
+	q := l.next(3)
+	if len(q) != 3 || q[0].n != near || q[1].n != fast || q[2].n != slow {
+		t.Fatal()
+	}
+}
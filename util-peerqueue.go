@@ -0,0 +1,179 @@
+package dht
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Determines which results are discarded when a subscriber's queue is full.
+type OverflowPolicy int
+
+const (
+	// The oldest queued result is discarded to make room for the new one.
+	OverflowDropOldest OverflowPolicy = iota
+
+	// The new result is discarded.
+	OverflowDropNewest
+
+	// A result identical to one already queued is merged with it rather than
+	// queued again, even if the queue is not full. When full, the new result
+	// replaces the oldest queued result for the same infohash, so that one busy
+	// infohash cannot starve the others; if there is none, it is discarded.
+	OverflowCoalesce
+)
+
+// A bounded queue of peer results for a single subscriber. Results are pushed
+// from the control loop without blocking and delivered on a channel by a
+// goroutine of the queue's own, so that a slow subscriber only loses its own
+// results. One further result may be held by that goroutine awaiting
+// delivery.
+type peerQueue struct {
+	mutex   sync.Mutex
+	items   []PeerResult
+	limit   int
+	policy  OverflowPolicy
+	ending  bool // Close once the queued results have been delivered.
+	dropped *uint64
+
+	wakeChan  chan struct{} // Signalled when items are added or ending is set.
+	abortChan chan struct{} // Closed to discard the queued results and close.
+	abortOnce sync.Once
+	outChan   chan PeerResult
+	doneChan  chan struct{} // Closed once outChan is closed.
+}
+
+// Creates a queue holding up to limit results. Each discarded result is
+// counted in *dropped, which is updated atomically.
+func newPeerQueue(limit int, policy OverflowPolicy, dropped *uint64) *peerQueue {
+	q := &peerQueue{
+		limit:     limit,
+		policy:    policy,
+		dropped:   dropped,
+		wakeChan:  make(chan struct{}, 1),
+		abortChan: make(chan struct{}),
+		outChan:   make(chan PeerResult),
+		doneChan:  make(chan struct{}),
+	}
+
+	go q.deliverLoop()
+	return q
+}
+
+// Returns the channel on which results are delivered. It is closed once the
+// queue has ended or been aborted.
+func (q *peerQueue) Chan() <-chan PeerResult {
+	return q.outChan
+}
+
+// Returns a channel which is closed once the queue has ended or been aborted
+// and the results channel has been closed.
+func (q *peerQueue) Done() <-chan struct{} {
+	return q.doneChan
+}
+
+// Queue a result. Never blocks.
+func (q *peerQueue) Push(r PeerResult) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.ending {
+		return
+	}
+
+	if q.policy == OverflowCoalesce {
+		for _, x := range q.items {
+			if x.InfoHash == r.InfoHash && x.Addr.String() == r.Addr.String() {
+				return
+			}
+		}
+	}
+
+	if len(q.items) >= q.limit {
+		atomic.AddUint64(q.dropped, 1)
+
+		switch q.policy {
+		case OverflowDropOldest:
+			q.items = q.items[1:]
+		case OverflowDropNewest:
+			return
+		case OverflowCoalesce:
+			i := q.indexOf(r.InfoHash)
+			if i < 0 {
+				return
+			}
+			q.items = append(q.items[:i], q.items[i+1:]...)
+		}
+	}
+
+	q.items = append(q.items, r)
+	q.wake()
+}
+
+func (q *peerQueue) indexOf(infoHash InfoHash) int {
+	for i, x := range q.items {
+		if x.InfoHash == infoHash {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (q *peerQueue) wake() {
+	select {
+	case q.wakeChan <- struct{}{}:
+	default:
+	}
+}
+
+// Close the channel once the results already queued have been delivered.
+// Further results are ignored.
+func (q *peerQueue) End() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.ending = true
+	q.wake()
+}
+
+// Discard the queued results and close the channel. May be called more than
+// once, and after End.
+func (q *peerQueue) Abort() {
+	q.End()
+	q.abortOnce.Do(func() {
+		close(q.abortChan)
+	})
+}
+
+func (q *peerQueue) deliverLoop() {
+	defer close(q.doneChan)
+	defer close(q.outChan)
+
+	for {
+		q.mutex.Lock()
+		if len(q.items) == 0 {
+			ending := q.ending
+			q.mutex.Unlock()
+			if ending {
+				return
+			}
+
+			select {
+			case <-q.wakeChan:
+				continue
+			case <-q.abortChan:
+				return
+			}
+		}
+
+		r := q.items[0]
+		q.items = q.items[1:]
+		q.mutex.Unlock()
+
+		select {
+		case q.outChan <- r:
+		case <-q.abortChan:
+			return
+		}
+	}
+}
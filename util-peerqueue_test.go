@@ -0,0 +1,125 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func peerQueueTestResult(b0 byte, port int) PeerResult {
+	ih := make([]byte, 20)
+	ih[0] = b0
+	return PeerResult{
+		InfoHash: InfoHash(ih),
+		Addr:     net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: port},
+	}
+}
+
+// Returns a queue whose results are not delivered, so that its contents can
+// be examined.
+func peerQueueTestQueue(limit int, policy OverflowPolicy, dropped *uint64) *peerQueue {
+	return &peerQueue{
+		limit:    limit,
+		policy:   policy,
+		dropped:  dropped,
+		wakeChan: make(chan struct{}, 1),
+	}
+}
+
+func peerQueueTestPorts(q *peerQueue) []int {
+	var ports []int
+	for _, r := range q.items {
+		ports = append(ports, r.Addr.Port)
+	}
+	return ports
+}
+
+func peerQueueTestEqual(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPeerQueueOverflow(t *testing.T) {
+	var dropped uint64
+
+	q := peerQueueTestQueue(2, OverflowDropOldest, &dropped)
+	for i := 1; i <= 3; i++ {
+		q.Push(peerQueueTestResult(1, i))
+	}
+	if !peerQueueTestEqual(peerQueueTestPorts(q), []int{2, 3}) || dropped != 1 {
+		t.Fatalf("drop oldest: %v %d", peerQueueTestPorts(q), dropped)
+	}
+
+	q = peerQueueTestQueue(2, OverflowDropNewest, &dropped)
+	for i := 1; i <= 3; i++ {
+		q.Push(peerQueueTestResult(1, i))
+	}
+	if !peerQueueTestEqual(peerQueueTestPorts(q), []int{1, 2}) || dropped != 2 {
+		t.Fatalf("drop newest: %v %d", peerQueueTestPorts(q), dropped)
+	}
+
+	// Duplicates are merged without counting as dropped. When full, a result
+	// replaces the oldest one for its own infohash, or is dropped.
+	q = peerQueueTestQueue(3, OverflowCoalesce, &dropped)
+	q.Push(peerQueueTestResult(1, 1))
+	q.Push(peerQueueTestResult(1, 1))
+	q.Push(peerQueueTestResult(2, 2))
+	q.Push(peerQueueTestResult(1, 3))
+	if !peerQueueTestEqual(peerQueueTestPorts(q), []int{1, 2, 3}) || dropped != 2 {
+		t.Fatalf("coalesce: %v %d", peerQueueTestPorts(q), dropped)
+	}
+
+	q.Push(peerQueueTestResult(1, 4))
+	if !peerQueueTestEqual(peerQueueTestPorts(q), []int{2, 3, 4}) || dropped != 3 {
+		t.Fatalf("coalesce: %v %d", peerQueueTestPorts(q), dropped)
+	}
+
+	q.Push(peerQueueTestResult(3, 5))
+	if !peerQueueTestEqual(peerQueueTestPorts(q), []int{2, 3, 4}) || dropped != 4 {
+		t.Fatalf("coalesce: %v %d", peerQueueTestPorts(q), dropped)
+	}
+}
+
+func TestPeerQueueDelivery(t *testing.T) {
+	var dropped uint64
+
+	// Ending the queue closes the channel once the queued results are read.
+	q := newPeerQueue(10, OverflowDropOldest, &dropped)
+	for i := 1; i <= 3; i++ {
+		q.Push(peerQueueTestResult(1, i))
+	}
+	q.End()
+	q.Push(peerQueueTestResult(1, 4))
+
+	var ports []int
+	for r := range q.Chan() {
+		ports = append(ports, r.Addr.Port)
+	}
+	if !peerQueueTestEqual(ports, []int{1, 2, 3}) || dropped != 0 {
+		t.Fatalf("%v %d", ports, dropped)
+	}
+
+	// Aborting the queue closes the channel without delivering the rest.
+	q = newPeerQueue(10, OverflowDropOldest, &dropped)
+	for i := 1; i <= 3; i++ {
+		q.Push(peerQueueTestResult(1, i))
+	}
+	q.End()
+	q.Abort()
+	q.Abort()
+
+	select {
+	case <-q.Done():
+	case <-time.After(1 * time.Second):
+		t.Fatal("queue not closed after abort")
+	}
+	for range q.Chan() {
+	}
+}
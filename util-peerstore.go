@@ -11,9 +11,6 @@ type peerSet struct {
 	// The set of values.
 	values map[string]struct{}
 
-	// Immutable/mutable datum, if present.
-	datum *Datum
-
 	// Needed to ensure different peers are returned each time.
 	ring *ring.Ring
 }
@@ -44,15 +41,6 @@ func (ps *peerSet) Next() []net.UDPAddr {
 	return xs
 }
 
-func (ps *peerSet) Datum() *Datum {
-	return ps.datum
-}
-
-func (ps *peerSet) PutDatum(datum *Datum) bool {
-	ps.datum = datum
-	return true
-}
-
 // Add an address to the value set. Returns true if the address was not
 // already in the value set.
 func (ps *peerSet) Put(addr net.UDPAddr) bool {
@@ -128,15 +116,6 @@ func (ps *peerStore) Values(infoHash InfoHash) []net.UDPAddr {
 	return set.Next()
 }
 
-func (ps *peerStore) Datum(infoHash InfoHash) *Datum {
-	set := ps.Set(infoHash)
-	if set == nil {
-		return nil
-	}
-
-	return set.Datum()
-}
-
 // Add the given address as a value for the provided infohash.
 // Returns true if the address was added.
 func (ps *peerStore) Add(infoHash InfoHash, addr net.UDPAddr) bool {
@@ -155,14 +134,3 @@ func (ps *peerStore) Add(infoHash InfoHash, addr net.UDPAddr) bool {
 	ps.values.Add(string(infoHash), set)
 	return set.Put(addr)
 }
-
-// Add the given datum as a value for the provided infohash.
-// Returns true if the datum was added.
-func (ps *peerStore) AddDatum(infoHash InfoHash, datum *Datum) bool {
-	set := ps.Set(infoHash)
-	if set == nil {
-		set = newValueSet()
-	}
-
-	return set.PutDatum(datum)
-}
@@ -192,3 +192,12 @@ func (rt *routingTree) cut(infoHash InfoHash, i int) (cutMe bool) {
 
 	return false
 }
+
+// Remove a node from the tree.
+func (rt *routingTree) Remove(n *node) {
+	rt.Cut(InfoHash(n.NodeID))
+}
+
+// The tree does not depend on our own node ID.
+func (rt *routingTree) SetNodeID(nodeID NodeID) {
+}
@@ -7,6 +7,64 @@ import (
 
 var crc32c = crc32.MakeTable(crc32.Castagnoli)
 
+// Determines how the BEP 42 node ID restrictions are applied to other nodes.
+type NodeIDPolicy int
+
+const (
+	// Node IDs are not checked.
+	NodeIDPolicyIgnore NodeIDPolicy = iota
+
+	// Nodes whose IDs do not match their IP are still used, but nodes with
+	// matching IDs are preferred for storing announcements and data.
+	NodeIDPolicyPrefer
+
+	// As for NodeIDPolicyPrefer, but nodes whose IDs do not match their IP are
+	// also never added to the routing table or returned to other nodes.
+	NodeIDPolicyEnforce
+)
+
+// Addresses exempt from the node ID restrictions. These are the local networks
+// listed in BEP 42, plus their IPv6 equivalents.
+var nodeIDExemptNets = mustParseCIDRs(
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"169.254.0.0/16",
+	"127.0.0.0/8",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// Returns true iff the IP is a local address exempt from the node ID
+// restrictions.
+func nodeIDIsExempt(ip net.IP) bool {
+	for _, n := range nodeIDExemptNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true iff a node at the IP may use the node ID, either because the
+// node ID matches the IP or because the IP is exempt.
+func nodeIDIsSecure(ip net.IP, nodeID NodeID) bool {
+	return nodeIDIsExempt(ip) || nodeIDIsAllowed(ip, nodeID)
+}
+
 func nodeIDIsAllowed(ip net.IP, nodeID NodeID) bool {
 	return conformNodeID(ip, nodeID) == nodeID
 }
@@ -65,3 +65,18 @@ func TestSecurityKAT(t *testing.T) {
 		}
 	}
 }
+
+func TestSecurityExempt(t *testing.T) {
+	nodeID := GenerateNodeID()
+
+	for _, ipstr := range []string{"10.1.2.3", "172.16.0.1", "192.168.1.1", "169.254.0.1", "127.0.0.1", "::1", "fd00::1"} {
+		if !nodeIDIsSecure(net.ParseIP(ipstr), nodeID) {
+			t.Fatalf("%v should be exempt", ipstr)
+		}
+	}
+
+	ip := net.ParseIP("124.31.75.21")
+	if nodeIDIsSecure(ip, nodeID) && !nodeIDIsAllowed(ip, nodeID) {
+		t.Fatalf("public address should not be exempt")
+	}
+}